@@ -0,0 +1,316 @@
+package gogen
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"dgen/parser"
+	"dgen/utils"
+)
+
+type gatewayStats struct {
+	Name    string
+	Routes  []*gatewayRoute
+	Methods []*gatewayMethod
+}
+
+// gatewayRoute is the methods served at the same path
+type gatewayRoute struct {
+	Path    string
+	Methods []*gatewayMethod
+}
+
+type gatewayMethod struct {
+	*serviceMember
+	HTTPMethod string
+	Query      bool // the request is decoded from the query parameters
+	Fields     []*queryField
+	Unset      []string // the required fields which can't be set by the query
+	Validate   string   // the validator of the JSON request
+}
+
+// queryField is a field of the request which can be set by the query parameter
+type queryField struct {
+	Key      string // the name of the query parameter
+	Name     string
+	Type     string
+	Parse    string // the call parsing v, it is empty for string
+	Pointer  bool   // the field is an optional scalar held by a pointer
+	Required bool   // the query parameter must be present
+}
+
+// gatewayValidator checks the required fields of a message are present in the
+// JSON object, the nested messages are checked by their own validators
+type gatewayValidator struct {
+	Func   string
+	Name   string
+	Fields []*validatedField
+}
+
+type validatedField struct {
+	Name     string
+	Required bool
+	Nullable bool   // null is the same as missing, the field is not a scalar
+	Check    string // the validator of the value, empty if there is nothing to check
+}
+
+// the HTTP/JSON gateways of the services are defined here
+func (g *Gogen) genGateway() error {
+	f, err := os.Create(path.Join(g.Output, fmt.Sprintf("%s.gateway.go", identifier(baseName(g.parser)))))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gatewayTmpl.Execute(f, g)
+}
+
+// convertGateway converts the services into the routes of the gateways, the
+// streaming methods are not served over HTTP
+func (g *Gogen) convertGateway() error {
+	imports := make(map[string]struct{})
+	std := map[string]struct{}{
+		"encoding/json": {},
+		"net/http":      {},
+		"sort":          {},
+		"strings":       {},
+	}
+	if g.Context {
+		std["context"] = struct{}{}
+	}
+
+	validators := make(map[*parser.MessageStat]string)
+	for i, service := range g.parser.ServiceStats {
+		gs := &gatewayStats{Name: service.Name}
+		routes := make(map[string]*gatewayRoute)
+		for j, m := range service.Members {
+			sm := g.ServiceStats[i].Members[j]
+			if sm.Stream {
+				continue
+			}
+
+			method, path := service.HTTPRoute(m)
+			gm := &gatewayMethod{
+				serviceMember: sm,
+				HTTPMethod:    method,
+				Query:         method == "GET" || method == "DELETE",
+			}
+			names := append([]string{m.Req}, m.Throws...)
+			if m.Resp != "" {
+				names = append(names, m.Resp)
+			}
+			for _, name := range names {
+				if _, err := g.getType(name, imports, nil); err != nil {
+					return err
+				}
+			}
+			if len(m.Throws) != 0 {
+				std["errors"] = struct{}{}
+			}
+			if gm.Query {
+				fields, unset, err := g.queryFields(m.Req, imports)
+				if err != nil {
+					return err
+				}
+				gm.Fields, gm.Unset = fields, unset
+				for _, field := range fields {
+					if strings.HasPrefix(field.Parse, "strconv.") {
+						std["strconv"] = struct{}{}
+					}
+				}
+			} else {
+				std["errors"] = struct{}{}
+				std["io"] = struct{}{}
+				file, ms := declaredMessage(g.parser, m.Req)
+				gm.Validate = g.validator(file, ms, validators)
+			}
+
+			route, ok := routes[path]
+			if !ok {
+				route = &gatewayRoute{Path: path}
+				routes[path] = route
+				gs.Routes = append(gs.Routes, route)
+			}
+			route.Methods = append(route.Methods, gm)
+			gs.Methods = append(gs.Methods, gm)
+		}
+		g.GatewayStats = append(g.GatewayStats, gs)
+	}
+
+	if len(g.GatewayValidators) != 0 {
+		std["fmt"] = struct{}{}
+	}
+	g.GatewayStdImports = sortedKeys(std)
+	g.GatewayImports = sortedKeys(imports)
+	return nil
+}
+
+// queryFields returns the fields of the request which can be set by the query
+// parameters, they are the fields of builtin scalar types and enums. The
+// required fields of the other types are returned as unset.
+func (g *Gogen) queryFields(req string, imports map[string]struct{}) ([]*queryField, []string, error) {
+	info := g.types[req]
+	var message *parser.MessageStat
+	for _, ms := range info.file.MessageStats {
+		if ms.Name == info.name {
+			message = ms
+		}
+	}
+
+	var fields []*queryField
+	var unset []string
+	for _, m := range message.Members {
+		typ, ok := m.Type.(string)
+		if !ok || typ == "bytes" {
+			if !m.Optional {
+				unset = append(unset, m.Name)
+			}
+			continue
+		}
+		field := &queryField{
+			Key:      utils.FirstLower(m.Name),
+			Name:     m.Name,
+			Type:     typ,
+			Pointer:  m.Optional,
+			Required: !m.Optional,
+		}
+
+		switch typ {
+		case "string":
+		case "bool":
+			field.Parse = "strconv.ParseBool(v[0])"
+		case "int8", "int16", "int32", "int64":
+			field.Parse = fmt.Sprintf("strconv.ParseInt(v[0], 10, %s)", strings.TrimPrefix(typ, "int"))
+		case "uint8", "uint16", "uint32", "uint64":
+			field.Parse = fmt.Sprintf("strconv.ParseUint(v[0], 10, %s)", strings.TrimPrefix(typ, "uint"))
+		case "float32", "float64":
+			field.Parse = fmt.Sprintf("strconv.ParseFloat(v[0], %s)", strings.TrimPrefix(typ, "float"))
+		default:
+			t, ok := g.types[utils.FirstUpper(typ)]
+			if !ok || t.message {
+				if !m.Optional {
+					unset = append(unset, m.Name)
+				}
+				continue
+			}
+			goType, err := g.getType(typ, imports, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			field.Type = goType
+			if i := strings.LastIndex(goType, "."); i >= 0 {
+				field.Parse = fmt.Sprintf("%sParse%s(v[0])", goType[:i+1], goType[i+1:])
+			} else {
+				field.Parse = fmt.Sprintf("Parse%s(v[0])", goType)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, unset, nil
+}
+
+// validator returns the name of the func checking the required fields of the
+// message declared in file, the validators of the nested messages are added
+// too. The messages of the imported files are checked by the validators of the
+// gateway as well, as they are generated into other packages.
+func (g *Gogen) validator(file *parser.Parser, ms *parser.MessageStat, validators map[*parser.MessageStat]string) string {
+	if fn, ok := validators[ms]; ok {
+		return fn
+	}
+	// the imported packages may have the same name, the funcs are numbered
+	// if they collide
+	name := "validate" + ms.Name
+	if file != g.parser {
+		name = "validate" + utils.FirstUpper(identifier(packageName(file))) + ms.Name
+	}
+	fn := name
+	for i := 2; g.hasValidator(fn); i++ {
+		fn = fmt.Sprintf("%s%d", name, i)
+	}
+	v := &gatewayValidator{Func: fn, Name: ms.Name}
+	validators[ms] = fn
+	g.GatewayValidators = append(g.GatewayValidators, v)
+
+	for _, m := range ms.Members {
+		v.Fields = append(v.Fields, &validatedField{
+			Name:     m.Name,
+			Required: !m.Optional,
+			Nullable: nullable(file, m.Type),
+			Check:    g.valueValidator(file, m.Type, validators),
+		})
+	}
+	return fn
+}
+
+func (g *Gogen) hasValidator(fn string) bool {
+	for _, v := range g.GatewayValidators {
+		if v.Func == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// valueValidator returns the validator of the value of typ used in file, it is
+// empty if the value has no required fields.
+func (g *Gogen) valueValidator(file *parser.Parser, typ interface{}, validators map[*parser.MessageStat]string) string {
+	switch v := typ.(type) {
+	case parser.ListType:
+		ele := g.valueValidator(file, v.Ele, validators)
+		if ele == "" {
+			return ""
+		}
+		g.GatewayLists = true
+		return "listOf(" + ele + ")"
+	case parser.MapType:
+		val := g.valueValidator(file, v.Val, validators)
+		if val == "" {
+			return ""
+		}
+		g.GatewayMaps = true
+		return "mapOf(" + val + ")"
+	case string:
+		if parser.IsBuiltin(v) {
+			return ""
+		}
+		if dep, ms := declaredMessage(file, v); ms != nil {
+			return g.validator(dep, ms, validators)
+		}
+	}
+	return ""
+}
+
+// nullable reports whether the value of typ used in file is held by a nil-able
+// go type, they are bytes, lists, maps and messages
+func nullable(file *parser.Parser, typ interface{}) bool {
+	v, ok := typ.(string)
+	if !ok || v == "bytes" {
+		return true
+	}
+	if parser.IsBuiltin(v) {
+		return false
+	}
+	_, ms := declaredMessage(file, v)
+	return ms != nil
+}
+
+// declaredMessage returns the message named name used in file, it is declared
+// in file or in the files imported by it.
+func declaredMessage(file *parser.Parser, name string) (*parser.Parser, *parser.MessageStat) {
+	files := []*parser.Parser{file}
+	for _, is := range file.ImportStats {
+		if is.File != nil {
+			files = append(files, is.File)
+		}
+	}
+	for _, f := range files {
+		for _, ms := range f.MessageStats {
+			if ms.Name == utils.FirstUpper(name) {
+				return f, ms
+			}
+		}
+	}
+	return nil, nil
+}
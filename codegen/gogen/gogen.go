@@ -1,25 +1,55 @@
 package gogen
 
 import (
+	"errors"
 	"fmt"
+	"go/token"
 	"io"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"dgen/config"
 	"dgen/parser"
+	"dgen/utils"
 )
 
 type Gogen struct {
-	Name        string
-	Output      string
-	EncodeType  string
-	StructStats []*structStats
-	StructMap   map[string]struct{}
+	Name              string
+	Output            string
+	EncodeType        string
+	Context           bool     // pass context.Context to the service methods
+	StdImports        []string // the standard packages imported by the enum and struct file
+	Imports           []string // the import specs of the enum and struct file
+	ServiceImports    []string // the import specs of the drpc file
+	ServiceStdImports []string // the standard packages imported by the drpc file
+	MockImports       []string // the import specs of the mock file
+	GatewayStdImports []string // the standard packages imported by the gateway file
+	GatewayImports    []string // the import specs of the gateway file
+	GatewayStats      []*gatewayStats
+	GatewayValidators []*gatewayValidator // check the required fields of the JSON requests
+	GatewayLists      bool                // some validators check the elements of lists
+	GatewayMaps       bool                // some validators check the values of maps
+	EnumStats         []*parser.EnumStat
+	StructStats       []*structStats
+	ServiceStats      []*serviceStats
+	MessageRefs       []*typeRef
+	EnumRefs          []*typeRef
+	StructMap         map[string]struct{}
+	EnumMap           map[string]struct{} // the go types of the used enums
+	ErrorMap          map[string]bool     // the messages thrown by the service methods
+	Throws            bool                // some service methods throw errors
+	Streams           bool                // some service methods are streaming
 
 	parser *parser.Parser
+	config *config.CodegenConfig
+	types  map[string]*typeInfo
+	// the names of the imported go packages, keyed by the import path
+	aliases map[string]string
+	// avoid repeated generation
+	serializationMap map[string]bool
 }
 
 type structStats struct {
@@ -27,65 +57,345 @@ type structStats struct {
 	Members []*structMember
 }
 
+// RequiredScalars reports whether the message has a required scalar member,
+// its presence can't be told by its value in json.
+func (s *structStats) RequiredScalars() bool {
+	for _, m := range s.Members {
+		if m.Scalar && !m.Optional {
+			return true
+		}
+	}
+	return false
+}
+
 type structMember struct {
 	Seq      uint8
 	Optional bool
+	Scalar   bool // a number, string, bool or enum
 	Type     string
 	Name     string
 }
 
+// Pointer reports whether the member is held by a pointer to tell the absence
+// from the zero value, it is true for the optional scalar.
+func (m *structMember) Pointer() bool {
+	return m.Optional && m.Scalar
+}
+
+// FieldType returns the type of the struct field of the member
+func (m *structMember) FieldType() string {
+	if m.Pointer() {
+		return "*" + m.Type
+	}
+	return m.Type
+}
+
+// Tag returns the tag of the struct field of the member
+func (m *structMember) Tag() string {
+	if m.Optional {
+		return "`json:\",omitempty\"`"
+	}
+	return ""
+}
+
+type serviceStats struct {
+	Name    string
+	Members []*serviceMember
+	Streams bool // some methods are streaming
+}
+
+type serviceMember struct {
+	Name       string
+	Req        string // the go type of request, without the pointer
+	Resp       string
+	ReqStream  bool
+	RespStream bool
+	Stream     bool // ReqStream or RespStream
+	Throws     []string
+}
+
+// typeRef is an enum or message used by the generated code, Type is
+// qualified by the package name if it is declared in an imported file.
+type typeRef struct {
+	Name      string
+	Type      string
+	Qualifier string // the package name followed by a dot, or empty
+}
+
+type typeInfo struct {
+	name    string // the declared name
+	message bool
+	file    *parser.Parser
+}
+
+// Gen generates the go code for the IDL file and for all the files it imports,
+// every file is placed in its own package.
 func Gen(config *config.CodegenConfig) error {
-	gogen, err := NewGogen(config.Filename, config.OutputDir, config.EncodeType)
+	files, err := parser.Load(config.Filename, config.IncludePaths)
 	if err != nil {
 		return err
 	}
-	return gogen.Gen()
-}
 
-func NewGogen(filepath string, outputDir string, encode string) (*Gogen, error) {
-	f, err := os.Open(filepath)
-	if err != nil {
-		return nil, err
+	var diags parser.Diagnostics
+	for _, f := range files {
+		if err := parser.Check(f); err != nil {
+			var ds parser.Diagnostics
+			if !errors.As(err, &ds) {
+				return err
+			}
+			diags = append(diags, ds...)
+		}
+	}
+	if len(diags) != 0 {
+		return diags
+	}
+
+	// every file is generated into its own go package
+	gogens := make([]*Gogen, 0, len(files))
+	outputs := make(map[string]string)
+	for _, f := range files {
+		g := NewGogen(f, config)
+		if prev, ok := outputs[g.Output]; ok {
+			return fmt.Errorf("%s and %s are generated into the same dir %s, declare different package or go_package for them", prev, f.Filename, g.Output)
+		}
+		outputs[g.Output] = f.Filename
+		gogens = append(gogens, g)
+	}
+
+	// the thrown messages implement error in the file declaring them
+	for _, f := range files {
+		for _, service := range f.ServiceStats {
+			for _, m := range service.Members {
+				for _, name := range m.Throws {
+					decl := declaringFile(f, name)
+					for _, g := range gogens {
+						if g.parser == decl {
+							g.ErrorMap[name] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// all the files are converted before any of them is written, so nothing
+	// is written on error
+	for _, g := range gogens {
+		if err := g.convert(); err != nil {
+			return err
+		}
+	}
+	for _, g := range gogens {
+		if err := g.generate(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	_, filename := path.Split(filepath)
-	filename = strings.Split(filename, ".")[0]
+func NewGogen(p *parser.Parser, config *config.CodegenConfig) *Gogen {
 	return &Gogen{
-		Name:       filename,
-		Output:     path.Join(outputDir, filename),
-		parser:     parser.NewParser(f),
-		EncodeType: encode,
-		StructMap:  make(map[string]struct{}),
-	}, nil
+		Name:             packageName(p),
+		Output:           path.Join(config.OutputDir, packageDir(p, config)),
+		parser:           p,
+		config:           config,
+		EncodeType:       config.EncodeType,
+		Context:          config.Context,
+		StructMap:        make(map[string]struct{}),
+		EnumMap:          make(map[string]struct{}),
+		ErrorMap:         make(map[string]bool),
+		types:            make(map[string]*typeInfo),
+		aliases:          make(map[string]string),
+		serializationMap: make(map[string]bool),
+	}
 }
 
 func (g *Gogen) Gen() error {
-	if err := g.parser.Parse(); err != nil {
-		log.Println("dgen:parse error:", err)
+	if err := g.convert(); err != nil {
+		return err
 	}
+	return g.generate()
+}
 
-	g.convertType()
-	if err := g.gen1(); err != nil {
+// convert prepares everything the templates need, it writes nothing
+func (g *Gogen) convert() error {
+	if err := g.convertType(); err != nil {
 		return err
 	}
+	if g.config.Gateway && len(g.ServiceStats) != 0 {
+		return g.convertGateway()
+	}
+	return nil
+}
 
-	if err := g.gen2(); err != nil {
+func (g *Gogen) generate() error {
+	if err := g.gen1(); err != nil {
 		return err
 	}
 
+	// the file without service doesn't need the drpc file
+	if len(g.ServiceStats) != 0 {
+		if err := g.gen2(); err != nil {
+			return err
+		}
+		if g.config.Mock {
+			if err := g.genMock(); err != nil {
+				return err
+			}
+		}
+		if g.config.Gateway {
+			if err := g.genGateway(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// declaringFile returns the file declaring the message used by p, it is p
+// itself or one of the files imported by p.
+func declaringFile(p *parser.Parser, name string) *parser.Parser {
+	for _, message := range p.MessageStats {
+		if message.Name == name {
+			return p
+		}
+	}
+	for _, is := range p.ImportStats {
+		if is.File == nil {
+			continue
+		}
+		for _, message := range is.File.MessageStats {
+			if message.Name == name {
+				return is.File
+			}
+		}
+	}
 	return nil
 }
 
+// packageName returns the go package name of the generated code of the file.
+// It is taken from the go_package option, then from the package declaration,
+// and at last from the file name.
+func packageName(p *parser.Parser) string {
+	if goPackage, ok := p.Option("go_package"); ok {
+		importPath, name, found := strings.Cut(goPackage, ";")
+		if found {
+			return name
+		}
+		return identifier(path.Base(importPath))
+	}
+	if p.Package != "" {
+		s := strings.Split(p.Package, ".")
+		return identifier(s[len(s)-1])
+	}
+	return identifier(baseName(p))
+}
+
+// packageDir returns the dir of the generated code of the file, relative to
+// the output dir.
+func packageDir(p *parser.Parser, config *config.CodegenConfig) string {
+	if goPackage, ok := p.Option("go_package"); ok {
+		importPath, _, _ := strings.Cut(goPackage, ";")
+		if config.ModulePath != "" && strings.HasPrefix(importPath, config.ModulePath+"/") {
+			return strings.TrimPrefix(importPath, config.ModulePath+"/")
+		}
+		return importPath
+	}
+	if p.Package != "" {
+		return strings.ReplaceAll(p.Package, ".", "/")
+	}
+	return packageName(p)
+}
+
+// importPath returns the go import path of the generated code of the file
+func (g *Gogen) importPath(p *parser.Parser) (string, error) {
+	if goPackage, ok := p.Option("go_package"); ok {
+		importPath, _, _ := strings.Cut(goPackage, ";")
+		return importPath, nil
+	}
+	if g.config.ModulePath == "" {
+		return "", fmt.Errorf("%s uses the types of %s, set the go import path of output dir by -m, or declare go_package in %s", g.parser.Filename, p.Filename, p.Filename)
+	}
+	return path.Join(g.config.ModulePath, packageDir(p, g.config)), nil
+}
+
+// stdNames are the names of the packages which may be imported by the
+// generated code besides the imported IDL files
+var stdNames = map[string]bool{
+	"binary":  true,
+	"context": true,
+	"drpc":    true,
+	"errors":  true,
+	"fmt":     true,
+	"http":    true,
+	"io":      true,
+	"json":    true,
+	"math":    true,
+	"reflect": true,
+	"sort":    true,
+	"strconv": true,
+	"strings": true,
+	"sync":    true,
+	"time":    true,
+}
+
+// importName returns the name of the imported go package in the generated
+// code. The name is numbered, like types2, if it is already used by another
+// import or by the std packages.
+func (g *Gogen) importName(importPath, name string) string {
+	if alias, ok := g.aliases[importPath]; ok {
+		return alias
+	}
+	used := make(map[string]bool, len(g.aliases))
+	for _, alias := range g.aliases {
+		used[alias] = true
+	}
+	alias := name
+	for i := 2; stdNames[alias] || used[alias]; i++ {
+		alias = fmt.Sprintf("%s%d", name, i)
+	}
+	g.aliases[importPath] = alias
+	return alias
+}
+
+// baseName returns the file name without the extension
+func baseName(p *parser.Parser) string {
+	filename := path.Base(filepath.ToSlash(p.Filename))
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
+
+// identifier converts s into a valid go identifier by replacing the invalid
+// characters with "_", e.g. "user-api.v2" is converted into "user_api_v2".
+func identifier(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	s = string(b)
+
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	if token.IsKeyword(s) {
+		s += "_"
+	}
+	return s
+}
+
 // enum and struct are defined here
 func (g *Gogen) gen1() error {
 	if err := os.MkdirAll(g.Output, os.ModePerm); err != nil {
 		return err
 	}
 
-	f, err := os.Create(path.Join(g.Output, fmt.Sprintf("%s.go", g.Name)))
+	f, err := os.Create(path.Join(g.Output, fmt.Sprintf("%s.go", identifier(baseName(g.parser)))))
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	if err := g.genHeader1(f); err != nil {
 		return err
@@ -112,15 +422,26 @@ func (g *Gogen) gen2() error {
 		return err
 	}
 
-	f, err := os.Create(path.Join(g.Output, fmt.Sprintf("%s.drpc.go", g.Name)))
+	f, err := os.Create(path.Join(g.Output, fmt.Sprintf("%s.drpc.go", identifier(baseName(g.parser)))))
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	if err := g.genHeader2(f); err != nil {
 		return err
 	}
 
+	if g.Context {
+		if err := contextTmpl.Execute(f, g); err != nil {
+			return err
+		}
+	}
+
+	if err := interceptorTmpl.Execute(f, g); err != nil {
+		return err
+	}
+
 	if err := g.genService(f); err != nil {
 		return err
 	}
@@ -129,9 +450,28 @@ func (g *Gogen) gen2() error {
 		return err
 	}
 
+	if err := g.genClient(f); err != nil {
+		return err
+	}
+
+	if err := localTmpl.Execute(f, g); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// the mocks of the services are defined here
+func (g *Gogen) genMock() error {
+	f, err := os.Create(path.Join(g.Output, fmt.Sprintf("%s.mock.go", identifier(baseName(g.parser)))))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return mockTmpl.Execute(f, g)
+}
+
 func (g *Gogen) genHeader1(w io.Writer) error {
 	if err := header1Tmpl.Execute(w, g); err != nil {
 		return err
@@ -147,11 +487,11 @@ func (g *Gogen) genHeader2(w io.Writer) error {
 }
 
 func (g *Gogen) genEnum(w io.Writer) error {
-	if err := enumTmpl.Execute(w, g.parser); err != nil {
+	if err := enumTmpl.Execute(w, g); err != nil {
 		return err
 	}
 	if g.EncodeType != "json" {
-		if err := enumSerializationTmpl.Execute(w, g.parser); err != nil {
+		if err := enumSerializationTmpl.Execute(w, g); err != nil {
 			return err
 		}
 	}
@@ -166,76 +506,306 @@ func (g *Gogen) genStruct(w io.Writer) error {
 }
 
 func (g *Gogen) genService(w io.Writer) error {
-	return serviceTmpl.Execute(w, g.parser)
+	return serviceTmpl.Execute(w, g)
+}
+
+func (g *Gogen) genClient(w io.Writer) error {
+	return clientTmpl.Execute(w, g)
 }
 
 func (g *Gogen) genRegisterFunc(w io.Writer) error {
-	if err := registerTmpl.Execute(w, g.parser); err != nil {
+	if err := registerTmpl.Execute(w, g); err != nil {
 		return err
 	}
 	return nil
 }
 
 // convert the message into struct
-func (g *Gogen) convertType() {
+func (g *Gogen) convertType() error {
+	g.EnumStats = g.parser.EnumStats
 	for _, message := range g.parser.MessageStats {
 		g.StructMap[message.Name] = struct{}{}
 	}
 
+	g.declareTypes(g.parser)
+	for _, is := range g.parser.ImportStats {
+		g.declareTypes(is.File)
+	}
+
+	imports := make(map[string]struct{})
+	refs := make(map[string]struct{})
 	for _, message := range g.parser.MessageStats {
 		ss := &structStats{
 			Name: message.Name,
 		}
 		for _, m := range message.Members {
-			sm := &structMember{
+			typ, err := g.getType(m.Type, imports, refs)
+			if err != nil {
+				return err
+			}
+			ss.Members = append(ss.Members, &structMember{
 				Seq:      m.Seq,
 				Optional: m.Optional,
-				Type:     g.getType(m.Type),
+				Scalar:   g.isScalar(m.Type),
+				Type:     typ,
 				Name:     m.Name,
+			})
+		}
+		g.StructStats = append(g.StructStats, ss)
+		refs[message.Name] = struct{}{}
+	}
+	g.StdImports = g.stdImports()
+	g.Imports = sortedKeys(imports)
+	for _, name := range sortedKeys(refs) {
+		typ, err := g.getType(name, imports, nil)
+		if err != nil {
+			return err
+		}
+		ref := &typeRef{
+			Name: g.types[name].name,
+			Type: strings.TrimPrefix(typ, "*"),
+		}
+		if i := strings.LastIndex(ref.Type, "."); i >= 0 {
+			ref.Qualifier = ref.Type[:i+1]
+		}
+		if g.types[name].message {
+			g.MessageRefs = append(g.MessageRefs, ref)
+		} else {
+			g.EnumRefs = append(g.EnumRefs, ref)
+			g.EnumMap[ref.Type] = struct{}{}
+		}
+	}
+
+	imports = make(map[string]struct{})
+	mockImports := make(map[string]struct{})
+	for _, service := range g.parser.ServiceStats {
+		ss := &serviceStats{
+			Name: service.Name,
+		}
+		for _, m := range service.Members {
+			sm := &serviceMember{
+				Name:       m.Name,
+				ReqStream:  m.ReqStream,
+				RespStream: m.RespStream,
+				Stream:     m.ReqStream || m.RespStream,
+			}
+			if sm.Stream {
+				ss.Streams = true
+				g.Streams = true
+			}
+			req, err := g.getType(m.Req, imports, nil)
+			if err != nil {
+				return err
+			}
+			sm.Req = strings.TrimPrefix(req, "*")
+			if m.Resp != "" {
+				resp, err := g.getType(m.Resp, imports, nil)
+				if err != nil {
+					return err
+				}
+				sm.Resp = strings.TrimPrefix(resp, "*")
+			}
+			// the mock only refers to the messages in the signatures of
+			// the client methods
+			if !m.ReqStream {
+				if _, err := g.getType(m.Req, mockImports, nil); err != nil {
+					return err
+				}
 			}
-			// if type is a struct, we use the pointer of the struct
-			if _, ok := g.StructMap[sm.Type]; ok {
-				sm.Type = fmt.Sprintf("*%s", sm.Type)
+			if m.Resp != "" && !sm.Stream {
+				if _, err := g.getType(m.Resp, mockImports, nil); err != nil {
+					return err
+				}
+			}
+			for _, name := range m.Throws {
+				typ, err := g.getType(name, imports, nil)
+				if err != nil {
+					return err
+				}
+				sm.Throws = append(sm.Throws, strings.TrimPrefix(typ, "*"))
+			}
+			if len(sm.Throws) != 0 {
+				g.Throws = true
 			}
 			ss.Members = append(ss.Members, sm)
 		}
-		g.StructStats = append(g.StructStats, ss)
+		g.ServiceStats = append(g.ServiceStats, ss)
 	}
+	g.ServiceImports = sortedKeys(imports)
+	g.MockImports = sortedKeys(mockImports)
+	g.ServiceStdImports = g.serviceStdImports()
+
+	return nil
 }
 
-func (g *Gogen) getType(v interface{}) string {
+// stdImports returns the standard packages used by the enum and struct file
+func (g *Gogen) stdImports() []string {
+	imports := make(map[string]struct{})
+	if len(g.EnumStats) != 0 {
+		imports["fmt"] = struct{}{}
+		imports["strconv"] = struct{}{}
+	}
+
+	if len(g.ErrorMap) != 0 {
+		imports["fmt"] = struct{}{}
+		imports["reflect"] = struct{}{}
+		imports["sort"] = struct{}{}
+		imports["strings"] = struct{}{}
+	}
+
+	if g.EncodeType == "json" {
+		if len(g.StructStats) != 0 {
+			imports["encoding/json"] = struct{}{}
+		}
+		for _, s := range g.StructStats {
+			for _, m := range s.Members {
+				if !m.Optional {
+					imports["fmt"] = struct{}{}
+				}
+			}
+			if s.RequiredScalars() {
+				imports["strings"] = struct{}{}
+			}
+		}
+		return sortedKeys(imports)
+	}
+
+	imports["encoding/binary"] = struct{}{}
+	imports["fmt"] = struct{}{}
+	imports["io"] = struct{}{}
+	imports["math"] = struct{}{}
+	return sortedKeys(imports)
+}
+
+// RequiredScalars reports whether any message has a required scalar member
+func (g *Gogen) RequiredScalars() bool {
+	for _, s := range g.StructStats {
+		if s.RequiredScalars() {
+			return true
+		}
+	}
+	return false
+}
+
+// isScalar reports whether typ is a builtin type other than bytes, or an enum
+func (g *Gogen) isScalar(typ interface{}) bool {
+	s, ok := typ.(string)
+	if !ok {
+		return false
+	}
+	switch s {
+	case "uint8", "uint16", "uint32", "uint64", "int8", "int16", "int32", "int64",
+		"float32", "float64", "string", "bool":
+		return true
+	case "bytes":
+		return false
+	}
+	t, ok := g.types[utils.FirstUpper(s)]
+	return ok && !t.message
+}
+
+// serviceStdImports returns the standard packages used by the drpc file
+func (g *Gogen) serviceStdImports() []string {
+	imports := make(map[string]struct{})
+	imports["fmt"] = struct{}{}
+	if g.Streams {
+		imports["errors"] = struct{}{}
+		imports["io"] = struct{}{}
+		imports["sync"] = struct{}{}
+	}
+	if g.Context {
+		imports["context"] = struct{}{}
+		imports["encoding/binary"] = struct{}{}
+		imports["errors"] = struct{}{}
+		imports["sort"] = struct{}{}
+		imports["time"] = struct{}{}
+	}
+	if g.Throws {
+		imports["errors"] = struct{}{}
+		imports["fmt"] = struct{}{}
+	}
+	return sortedKeys(imports)
+}
+
+// declareTypes records the enums and messages declared in the file
+func (g *Gogen) declareTypes(p *parser.Parser) {
+	if p == nil {
+		return
+	}
+	for _, enum := range p.EnumStats {
+		g.types[utils.FirstUpper(enum.Name)] = &typeInfo{name: enum.Name, file: p}
+	}
+	for _, message := range p.MessageStats {
+		g.types[utils.FirstUpper(message.Name)] = &typeInfo{name: message.Name, message: true, file: p}
+	}
+}
+
+// getType returns the go type of the IDL type. The go packages of the types
+// declared in the imported files are added to imports, and the names of the
+// used enums and messages are added to refs.
+func (g *Gogen) getType(v interface{}, imports map[string]struct{}, refs map[string]struct{}) (string, error) {
 	mapVal, ok := v.(parser.MapType)
 	if ok {
-		return g.getMap(mapVal)
+		val, err := g.getType(mapVal.Val, imports, refs)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("map[%s]%s", mapVal.Key, val), nil
 	}
 
 	listVal, ok := v.(parser.ListType)
 	if ok {
-		return g.getList(listVal)
+		ele, err := g.getType(listVal.Ele, imports, refs)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + ele, nil
 	}
 
 	stringVal, ok := v.(string)
-	if ok {
-		if _, ok := g.StructMap[stringVal]; ok {
-			stringVal = "*" + stringVal
+	if !ok {
+		return "", nil
+	}
+	// the builtin type goes first, it can't be shadowed by a declared type
+	if parser.IsBuiltin(stringVal) {
+		if stringVal == "bytes" {
+			return "[]byte", nil
 		}
-		return stringVal
+		return stringVal, nil
+	}
+	info, ok := g.types[utils.FirstUpper(stringVal)]
+	if !ok {
+		return stringVal, nil
 	}
 
-	return ""
-}
-
-func (g *Gogen) getMap(val parser.MapType) string {
-	s := ""
-	s += fmt.Sprintf("map[%s]", val.Key)
-	s += g.getType(val.Val)
-
-	return s
+	typ := info.name
+	if info.file != g.parser {
+		importPath, err := g.importPath(info.file)
+		if err != nil {
+			return "", err
+		}
+		name := g.importName(importPath, packageName(info.file))
+		if name == path.Base(importPath) {
+			imports[fmt.Sprintf("%q", importPath)] = struct{}{}
+		} else {
+			imports[fmt.Sprintf("%s %q", name, importPath)] = struct{}{}
+		}
+		typ = name + "." + typ
+	}
+	if refs != nil {
+		refs[utils.FirstUpper(stringVal)] = struct{}{}
+	}
+	if info.message {
+		typ = "*" + typ
+	}
+	return typ, nil
 }
 
-func (g *Gogen) getList(val parser.ListType) string {
-	s := "[]"
-	s += g.getType(val.Ele)
-
-	return s
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,2090 @@
+package gogen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dgen/config"
+)
+
+const testModule = "example.com/gen"
+
+// generate writes the IDL files into a temporary dir and generates the go code
+// of the main file with the options of cfg. The returned dir is the root of a
+// go module named testModule which contains the generated packages.
+func generate(t *testing.T, files map[string]string, main string, cfg config.CodegenConfig) string {
+	t.Helper()
+
+	src := t.TempDir()
+	for name, content := range files {
+		filename := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := t.TempDir()
+	cfg.Filename = filepath.Join(src, main)
+	cfg.IncludePaths = []string{src}
+	cfg.ModulePath = testModule
+	cfg.OutputDir = out
+	if err := Gen(&cfg); err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+
+	// the generated drpc files are compiled against the stand-in of drpc, and
+	// the streaming methods are carried by memstream
+	drpc, err := filepath.Abs(filepath.Join("testdata", "drpc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memstream, err := filepath.Abs(filepath.Join("testdata", "memstream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gomod := "module " + testModule + "\n\ngo 1.19\n\n" +
+		"require (\n\tgithub.com/fengluodb/drpc v0.0.0\n\texample.com/memstream v0.0.0\n)\n\n" +
+		"replace github.com/fengluodb/drpc => " + drpc + "\n\n" +
+		"replace example.com/memstream => " + memstream + "\n"
+	if err := os.WriteFile(filepath.Join(out, "go.mod"), []byte(gomod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// run compiles the program together with the generated packages and returns
+// its output.
+func run(t *testing.T, dir string, program string) string {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command is not available")
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "cmd"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cmd", "main.go"), []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(goBin, "run", "./cmd")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %s\n%s", err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestImport(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"api.dgen": `
+import "common/types.dgen";
+
+message GetUserResponse {
+	seq=1 User user;
+	optional seq=2 list[User] friends;
+	optional seq=3 map[string]User byName;
+}
+
+service UserService {
+	Save(User);
+}
+`,
+		"common/types.dgen": `
+message User {
+	seq=1 string name;
+	optional seq=2 int32 age;
+}
+`,
+	}, "api.dgen", config.CodegenConfig{})
+
+	drpc, err := os.ReadFile(filepath.Join(dir, "api", "api.drpc.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(drpc), `"example.com/gen/types"`) || !strings.Contains(string(drpc), "Save(*types.User) error") {
+		t.Errorf("unexpected drpc file:\n%s", drpc)
+	}
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/api"
+	"example.com/gen/types"
+)
+
+func age(v int32) *int32 {
+	return &v
+}
+
+func show(u *types.User) string {
+	return fmt.Sprintf("{%s %d}", u.Name, *u.Age)
+}
+
+func main() {
+	in := &api.GetUserResponse{
+		User:    &types.User{Name: "a", Age: age(1)},
+		Friends: []*types.User{{Name: "b", Age: age(2)}},
+		ByName:  map[string]*types.User{"c": {Name: "c", Age: age(3)}},
+	}
+	data, err := in.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	out := new(api.GetUserResponse)
+	if err := out.Unmarshal(data); err != nil {
+		panic(err)
+	}
+	fmt.Println(show(out.User), show(out.Friends[0]), show(out.ByName["c"]))
+}
+`)
+	if output != "{a 1} {b 2} {c 3}" {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+// the imported packages with the same name, or with the name of a std package,
+// are given unique names
+func TestImportNameClash(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"api.dgen": `
+import "x.dgen";
+import "y.dgen";
+import "io.dgen";
+
+message Pair {
+	seq=1 A a;
+	seq=2 B b;
+	seq=3 C c;
+}
+
+service Pairs {
+	Swap(Pair) return (Pair);
+}
+`,
+		"x.dgen":  "package x.types;\nmessage A { seq=1 string v; }\n",
+		"y.dgen":  "package y.types;\nmessage B { seq=1 Z z; }\nmessage Z { seq=1 int32 v; }\n",
+		"io.dgen": "package io;\nmessage C { seq=1 string v; }\n",
+	}, "api.dgen", config.CodegenConfig{Context: true, Gateway: true})
+
+	output := run(t, dir, `package main
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/gen/api"
+	iogen "example.com/gen/io"
+	xtypes "example.com/gen/x/types"
+	ytypes "example.com/gen/y/types"
+)
+
+type impl struct{}
+
+func (impl) Swap(ctx context.Context, args *api.Pair, reply *api.Pair) error {
+	*reply = *args
+	return nil
+}
+
+func main() {
+	client := api.NewPairsLocalClient(impl{})
+	reply := new(api.Pair)
+	err := client.Swap(context.Background(), &api.Pair{
+		A: &xtypes.A{V: "x"},
+		B: &ytypes.B{Z: &ytypes.Z{V: 1}},
+		C: &iogen.C{V: "c"},
+	}, reply)
+	fmt.Println(err, reply.A.V, reply.B.Z.V, reply.C.V)
+}
+`)
+	if output != "<nil> x 1 c" {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestGenErrorWritesNothing(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a.dgen": "import \"b.dgen\";\nmessage A { seq=1 B b; }\n",
+		"b.dgen": "message B { seq=1 int32 v; }\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b.dgen is generated before a.dgen, which fails without the module path
+	out := t.TempDir()
+	err := Gen(&config.CodegenConfig{Filename: filepath.Join(src, "a.dgen"), OutputDir: out})
+	if err == nil || !strings.Contains(err.Error(), "-m") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d entries are written on error", len(entries))
+	}
+}
+
+func TestPackage(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"user-api.v2.dgen": `
+import "common.dgen";
+import "status.dgen";
+
+message User {
+	seq=1 Name name;
+	seq=2 Status status;
+}
+`,
+		"common.dgen": `
+package acme.common;
+
+message Name {
+	seq=1 string first;
+}
+`,
+		"status.dgen": `
+option go_package = "example.com/gen/shared/status;codes";
+
+message Status {
+	seq=1 int32 code;
+}
+`,
+	}, "user-api.v2.dgen", config.CodegenConfig{})
+
+	for _, f := range []string{"user_api_v2/user_api_v2.go", "acme/common/common.go", "shared/status/status.go"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("%s is not generated: %s", f, err)
+		}
+	}
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/acme/common"
+	"example.com/gen/shared/status"
+	"example.com/gen/user_api_v2"
+)
+
+func main() {
+	in := &user_api_v2.User{Name: &common.Name{First: "a"}, Status: &codes.Status{Code: 1}}
+	data, err := in.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	out := new(user_api_v2.User)
+	if err := out.Unmarshal(data); err != nil {
+		panic(err)
+	}
+	fmt.Println(out.Name.First, out.Status.Code)
+}
+`)
+	if output != "a 1" {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestBoolBytes(t *testing.T) {
+	for _, encode := range []string{"", "json"} {
+		dir := generate(t, map[string]string{
+			"blob.dgen": `
+message Blob {
+	seq=1 bool valid;
+	optional seq=2 bool cached;
+	seq=3 bytes data;
+	optional seq=4 bytes checksum;
+	optional seq=5 list[bytes] chunks;
+	optional seq=6 map[string]bool flags;
+}
+`,
+		}, "blob.dgen", config.CodegenConfig{EncodeType: encode})
+
+		output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/blob"
+)
+
+func isTrue(v *bool) bool {
+	return v != nil && *v
+}
+
+func main() {
+	cached := true
+	for _, in := range []*blob.Blob{
+		{Valid: false, Data: []byte{}},
+		{Valid: true, Cached: &cached, Data: []byte{1, 2}, Checksum: []byte{3}, Chunks: [][]byte{{4}, {5, 6}}, Flags: map[string]bool{"a": true}},
+	} {
+		data, err := in.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		out := new(blob.Blob)
+		if err := out.Unmarshal(data); err != nil {
+			panic(err)
+		}
+		fmt.Println(out.Valid, isTrue(out.Cached), out.Data, out.Checksum, out.Chunks, out.Flags)
+	}
+
+	if _, err := (&blob.Blob{}).Marshal(); err == nil {
+		panic("required bytes is not checked")
+	}
+}
+`)
+		want := "false false [] [] [] map[]\ntrue true [1 2] [3] [[4] [5 6]] map[a:true]"
+		if output != want {
+			t.Errorf("encode %q: unexpected output:\n%s\nwant:\n%s", encode, output, want)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"user.dgen": `
+message User {
+	seq=1 string name;
+	optional seq=2 list[int32] scores;
+}
+`,
+	}, "user.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/user"
+)
+
+func main() {
+	data, err := (&user.User{Name: "bob", Scores: []int32{1, 2}}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	for _, in := range [][]byte{
+		data[:3],
+		data[:len(data)-1],
+		{1, 0xff, 0xff, 0xff, 0xff},
+		{1, 0xff, 0xff, 0xff, 0x7f, 'a'},
+		{1, 5, 0, 0, 0, 1, 0, 0, 0, 'a', 2, 4, 0, 0, 0, 0xff, 0xff, 0xff, 0x7f},
+	} {
+		fmt.Println(new(user.User).UnmarshalWithOptions(in, user.DecodeOptions{}))
+	}
+}
+`)
+	want := "unmarshal User.Name failed: unexpected EOF\n" +
+		"unmarshal User.Scores failed: unexpected EOF\n" +
+		"unmarshal User.Name failed: invalid length -1\n" +
+		"unmarshal User.Name failed: unexpected EOF\n" +
+		"unmarshal User.Scores failed: unexpected EOF"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"tree.dgen": `
+message Node {
+	seq=1 string name;
+	optional seq=2 list[int32] values;
+	optional seq=3 Node child;
+}
+`,
+	}, "tree.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/tree"
+)
+
+func main() {
+	in := &tree.Node{Name: "root", Values: []int32{1, 2}, Child: &tree.Node{Name: "a", Child: &tree.Node{Name: "b"}}}
+	data, err := in.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	for _, opts := range []tree.DecodeOptions{
+		{},
+		{MaxBytes: 10},
+		{MaxStringLength: 3},
+		{MaxCollectionSize: 1},
+		{MaxDepth: 3},
+		{MaxDepth: 2},
+	} {
+		fmt.Println(new(tree.Node).UnmarshalWithOptions(data, opts))
+	}
+	fmt.Println(new(tree.Node).Unmarshal([]byte{1, 5, 0, 0, 0, 1, 0, 0, 0, 'a', 2, 4, 0, 0, 0, 0xff, 0xff, 0xff, 0x7f}))
+}
+`)
+	want := "<nil>\n" +
+		"size 68 exceeds the limit 10\n" +
+		"unmarshal Node.Name failed: length 4 exceeds the limit 3\n" +
+		"unmarshal Node.Values failed: length 2 exceeds the limit 1\n" +
+		"<nil>\n" +
+		"unmarshal Node.Child failed: unmarshal Node.Child failed: nesting depth exceeds the limit\n" +
+		"unmarshal Node.Values failed: length 2147483647 exceeds the limit 65536"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestNestedDecoding(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"tree.dgen": `
+message Leaf {
+	seq=1 string name;
+}
+
+message Tree {
+	optional seq=1 list[Leaf] leaves;
+	optional seq=2 Leaf first;
+	seq=3 string name;
+}
+
+message Node {
+	optional seq=1 Node child;
+}
+`,
+	}, "tree.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+
+	"example.com/gen/tree"
+)
+
+func wide(n int) *tree.Tree {
+	t := &tree.Tree{First: &tree.Leaf{}, Name: "t"}
+	for i := 0; i < n; i++ {
+		t.Leaves = append(t.Leaves, &tree.Leaf{Name: fmt.Sprint(i)})
+	}
+	return t
+}
+
+func deep(n int) *tree.Node {
+	node := new(tree.Node)
+	for i := 0; i < n; i++ {
+		node = &tree.Node{Child: node}
+	}
+	return node
+}
+
+// linear reports whether decoding twice as much data allocates about twice as
+// many bytes, the decoding which re-reads the nested messages allocates four
+// times as many
+func linear(decode func(data []byte, opts tree.DecodeOptions) error, small, large []byte) bool {
+	allocated := func(data []byte) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if err := decode(data, tree.DecodeOptions{}); err != nil {
+			panic(err)
+		}
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	return allocated(large) < 3*allocated(small)
+}
+
+func main() {
+	in := wide(10000)
+
+	// the nested messages can be decoded from any reader
+	data, err := tree.MarshalTree(in)
+	if err != nil {
+		panic(err)
+	}
+	out, err := tree.UnmarshalTree(bytes.NewBuffer(data))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(len(out.Leaves), out.Leaves[9999].Name, out.First.Name == "", out.Name)
+
+	small, _ := wide(5000).Marshal()
+	large, _ := wide(10000).Marshal()
+	fmt.Println("wide", linear(func(data []byte, opts tree.DecodeOptions) error {
+		return new(tree.Tree).UnmarshalWithOptions(data, opts)
+	}, small, large))
+
+	small, _ = deep(1000).Marshal()
+	large, _ = deep(2000).Marshal()
+	fmt.Println("deep", linear(func(data []byte, opts tree.DecodeOptions) error {
+		return new(tree.Node).UnmarshalWithOptions(data, opts)
+	}, small, large))
+}
+`)
+	if output != "10000 9999 true t\nwide true\ndeep true" {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"person.dgen": `
+message PersonV1 {
+	seq=1 string name;
+}
+
+message PersonV2 {
+	seq=1 string name;
+	optional seq=2 list[int32] scores;
+	optional seq=3 string email;
+}
+
+# the helpers of Seq don't collide with the generated ones
+message Seq {
+	seq=1 int32 n;
+}
+`,
+	}, "person.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/person"
+)
+
+func main() {
+	// the old schema skips the fields added by the new one
+	email := "bob@example.com"
+	data, err := (&person.PersonV2{Name: "bob", Scores: []int32{1, 2}, Email: &email}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	v1 := new(person.PersonV1)
+	fmt.Println(v1.Unmarshal(data), v1.Name)
+
+	// the new schema reads the data of the old one
+	if data, err = v1.Marshal(); err != nil {
+		panic(err)
+	}
+	v2 := new(person.PersonV2)
+	fmt.Println(v2.Unmarshal(data), v2.Name, v2.Scores, v2.Email == nil)
+
+	// the fields may come in any order
+	v2 = new(person.PersonV2)
+	fmt.Println(v2.Unmarshal([]byte{3, 5, 0, 0, 0, 1, 0, 0, 0, 'e', 1, 5, 0, 0, 0, 1, 0, 0, 0, 'n'}), v2.Name, *v2.Email)
+
+	// a known field must be consumed exactly by its declared type
+	fmt.Println(v1.Unmarshal([]byte{1, 7, 0, 0, 0, 1, 0, 0, 0, 'n', 'x', 'y'}))
+}
+`)
+	want := "<nil> bob\n<nil> bob [] true\n<nil> n e\nunmarshal PersonV1.Name failed: 2 trailing bytes"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	for _, encode := range []string{"", "json"} {
+		dir := generate(t, map[string]string{
+			"account.dgen": `
+message Account {
+	seq=1 int32 balance;
+	seq=2 string note;
+	optional seq=3 int32 limit;
+	optional seq=4 string email;
+}
+`,
+		}, "account.dgen", config.CodegenConfig{EncodeType: encode})
+
+		output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/account"
+)
+
+func main() {
+	zero := int32(0)
+	for _, in := range []*account.Account{{}, {Limit: &zero}} {
+		data, err := in.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		out := new(account.Account)
+		if err := out.Unmarshal(data); err != nil {
+			panic(err)
+		}
+		fmt.Printf("%d %q %v %v\n", out.Balance, out.Note, out.Limit != nil && *out.Limit == 0, out.Email == nil)
+	}
+}
+`)
+		want := "0 \"\" false true\n0 \"\" true true"
+		if output != want {
+			t.Errorf("encode %q: unexpected output:\n%s\nwant:\n%s", encode, output, want)
+		}
+	}
+
+	dir := generate(t, map[string]string{
+		"account.dgen": `
+message Account {
+	seq=1 int32 balance;
+	optional seq=2 int32 limit;
+}
+`,
+	}, "account.dgen", config.CodegenConfig{EncodeType: "json"})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/account"
+)
+
+func main() {
+	data, _ := (&account.Account{}).Marshal()
+	fmt.Println(string(data))
+	fmt.Println(new(account.Account).Unmarshal([]byte(`+"`"+`{"limit": 1}`+"`"+`)))
+	fmt.Println(new(account.Account).Unmarshal([]byte(`+"`"+`{"balance": 0}`+"`"+`)))
+}
+`)
+	want := "{\"Balance\":0}\nunmarshal failed, don't find Balance\n<nil>"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestJSONNestedRequired(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"doc.dgen": `
+message Inner {
+	seq=1 string name;
+}
+
+message Outer {
+	seq=1 string name;
+	seq=2 bytes raw;
+	seq=3 Inner inner;
+	optional seq=4 list[Inner] items;
+	optional seq=5 map[string]Inner byName;
+}
+`,
+	}, "doc.dgen", config.CodegenConfig{EncodeType: "json"})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/doc"
+)
+
+func main() {
+	for _, data := range []string{
+		`+"`"+`{"Name":"a","Raw":"","Inner":{"Name":"b"},"Items":[{"Name":"c"}],"ByName":{"d":{"Name":"d"}}}`+"`"+`,
+		`+"`"+`{"Name":"a","Raw":"","Inner":{}}`+"`"+`,
+		`+"`"+`{"Name":"a","Raw":"","Inner":{"Name":"b"},"Items":[{"Name":"c"},{}]}`+"`"+`,
+		`+"`"+`{"Name":"a","Raw":"","Inner":{"Name":"b"},"ByName":{"d":{}}}`+"`"+`,
+	} {
+		fmt.Println(new(doc.Outer).Unmarshal([]byte(data)))
+	}
+}
+`)
+	want := "<nil>\nunmarshal failed, don't find Name\nunmarshal failed, don't find Name\nunmarshal failed, don't find Name"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+// Marshal checks the required fields of the nested messages as the default
+// encoding does
+func TestJSONNestedMarshal(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"doc.dgen": `
+message Leaf {
+	seq=1 bytes raw;
+}
+
+message Inner {
+	seq=1 Leaf leaf;
+}
+
+message Outer {
+	seq=1 Inner in;
+	optional seq=2 list[Inner] items;
+}
+`,
+	}, "doc.dgen", config.CodegenConfig{EncodeType: "json"})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/doc"
+)
+
+func main() {
+	leaf := &doc.Leaf{Raw: []byte{}}
+	for _, x := range []*doc.Outer{
+		{In: &doc.Inner{Leaf: leaf}, Items: []*doc.Inner{{Leaf: leaf}}},
+		{},
+		{In: &doc.Inner{}},
+		{In: &doc.Inner{Leaf: &doc.Leaf{}}},
+		{In: &doc.Inner{Leaf: leaf}, Items: []*doc.Inner{{}}},
+	} {
+		data, err := x.Marshal()
+		fmt.Println(string(data), err)
+	}
+}
+`)
+	want := `{"In":{"Leaf":{"Raw":""}},"Items":[{"Leaf":{"Raw":""}}]} <nil>
+ marshal failed, In must have value
+ json: error calling MarshalJSON for type *doc.Inner: marshal failed, Leaf must have value
+ json: error calling MarshalJSON for type *doc.Inner: json: error calling MarshalJSON for type *doc.Leaf: marshal failed, Raw must have value
+ json: error calling MarshalJSON for type *doc.Inner: marshal failed, Leaf must have value`
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestFloat(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"point.dgen": `
+message Point {
+	seq=1 float32 x;
+	seq=2 float64 y;
+	optional seq=3 float64 z;
+	optional seq=4 list[float32] weights;
+	optional seq=5 map[int32]float32 table;
+}
+`,
+	}, "point.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+	"math"
+
+	"example.com/gen/point"
+)
+
+func main() {
+	z := math.SmallestNonzeroFloat64
+	in := &point.Point{
+		X:       1.5,
+		Y:       math.Inf(-1),
+		Z:       &z,
+		Weights: []float32{math.MaxFloat32, -0.25, float32(math.NaN())},
+		Table:   map[int32]float32{math.MinInt32: 3.25},
+	}
+	data, err := in.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	out := new(point.Point)
+	if err := out.Unmarshal(data); err != nil {
+		panic(err)
+	}
+
+	fmt.Println(out.X, out.Y, *out.Z == math.SmallestNonzeroFloat64)
+	fmt.Println(out.Weights[0] == math.MaxFloat32, out.Weights[1], math.IsNaN(float64(out.Weights[2])))
+	fmt.Println(out.Table[math.MinInt32])
+}
+`)
+	if want := "1.5 -Inf true\ntrue -0.25 true\n3.25"; output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestEnumField(t *testing.T) {
+	for _, encode := range []string{"", "json"} {
+		dir := generate(t, map[string]string{
+			"order.dgen": `
+import "color.dgen";
+
+enum fruit {
+	apple,
+	banana
+}
+
+message order {
+	seq=1 fruit kind;
+	optional seq=2 color color;
+	optional seq=3 list[fruit] extras;
+	optional seq=4 map[string]fruit byName;
+}
+`,
+			"color.dgen": `
+enum color {
+	red,
+	green
+}
+`,
+		}, "order.dgen", config.CodegenConfig{EncodeType: encode})
+
+		output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/color"
+	"example.com/gen/order"
+)
+
+func main() {
+	green := color.Green
+	in := &order.Order{
+		Kind:   order.Banana,
+		Color:  &green,
+		Extras: []order.Fruit{order.Apple, order.Banana},
+		ByName: map[string]order.Fruit{"b": order.Banana},
+	}
+	data, err := in.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	out := new(order.Order)
+	if err := out.Unmarshal(data); err != nil {
+		panic(err)
+	}
+	fmt.Println(out.Kind == order.Banana, *out.Color == color.Green, out.Extras, out.ByName)
+}
+`)
+		if want := "true true [Apple Banana] map[b:Banana]"; output != want {
+			t.Errorf("encode %q: unexpected output:\n%s\nwant:\n%s", encode, output, want)
+		}
+	}
+}
+
+func TestEnumValue(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"status.dgen": `
+enum code {
+	ok,
+	notFound = 404,
+	internal = 500,
+	unavailable
+}
+
+message Reply {
+	seq=1 code code;
+	optional seq=2 list[code] history;
+}
+`,
+	}, "status.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/status"
+)
+
+func main() {
+	fmt.Println(status.Ok, status.NotFound, status.Internal, status.Unavailable)
+
+	in := &status.Reply{Code: status.NotFound, History: []status.Code{status.Unavailable}}
+	data, err := in.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	out := new(status.Reply)
+	fmt.Println(out.Unmarshal(data), out.Code, out.History)
+
+	// the undeclared values are neither encoded nor decoded
+	_, err = (&status.Reply{Code: 403}).Marshal()
+	fmt.Println(err)
+	_, err = (&status.Reply{Code: status.NotFound, History: []status.Code{7}}).Marshal()
+	fmt.Println(err)
+	_, err = status.MarshalCode(1)
+	fmt.Println(err)
+	fmt.Println(out.Unmarshal([]byte{1, 4, 0, 0, 0, 0x93, 1, 0, 0}))
+	fmt.Println(out.Unmarshal([]byte{1, 4, 0, 0, 0, 0x94, 1, 0, 0, 2, 8, 0, 0, 0, 1, 0, 0, 0, 7, 0, 0, 0}))
+
+	var c status.Code
+	fmt.Println(c.Unmarshal([]byte{1, 0, 0, 0}))
+	fmt.Println(c.Unmarshal([]byte{0xf4, 1, 0, 0}), c)
+}
+`)
+	want := `Ok NotFound Internal Unavailable
+<nil> NotFound [Unavailable]
+marshal Reply.Code failed: 403 is not a valid Code
+marshal Reply.History failed: element 0: 7 is not a valid Code
+1 is not a valid Code
+unmarshal Reply.Code failed: 403 is not a valid Code
+unmarshal Reply.History failed: 7 is not a valid Code
+unmarshal failed, 1 is not a valid Code
+<nil> Internal`
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestEnumText(t *testing.T) {
+	dir := generate(t, map[string]string{
+		"order.dgen": `
+enum fruit {
+	apple = 1,
+	banana
+}
+
+message Order {
+	seq=1 fruit kind;
+	optional seq=2 map[string]fruit byName;
+}
+`,
+	}, "order.dgen", config.CodegenConfig{EncodeType: "json"})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/order"
+)
+
+func main() {
+	fmt.Println(order.Fruit(7))
+	fmt.Println(order.ParseFruit("Banana"))
+	fmt.Println(order.ParseFruit("banana"))
+
+	data, err := (&order.Order{Kind: order.Apple, ByName: map[string]order.Fruit{"b": order.Banana}}).Marshal()
+	fmt.Println(string(data), err)
+	out := new(order.Order)
+	fmt.Println(out.Unmarshal(data), out.Kind, out.ByName)
+
+	_, err = (&order.Order{Kind: 7}).Marshal()
+	fmt.Println(err != nil)
+	fmt.Println(out.Unmarshal([]byte(`+"`"+`{"Kind":"Cherry"}`+"`"+`)))
+}
+`)
+	want := `Fruit(7)
+Banana <nil>
+Fruit(0) "banana" is not a valid Fruit
+{"Kind":"Apple","ByName":{"b":"Banana"}} <nil>
+<nil> Apple map[b:Banana]
+true
+"Cherry" is not a valid Fruit`
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+const greeterIDL = `
+message HelloRequest {
+	seq=1 string name;
+}
+
+message HelloResponse {
+	seq=1 string reply;
+}
+
+service Greeter {
+	SayHello(HelloRequest) return (HelloResponse);
+	Notify(HelloRequest);
+}
+`
+
+// the lower case names, even go keywords, are capitalised in the generated code
+func TestLowerCaseNames(t *testing.T) {
+	dir := generate(t, map[string]string{"calc.dgen": `
+message number {
+	seq=1 int32 value;
+}
+
+service calculator {
+	func(number) return (number);
+	range(number) return (stream number);
+}
+`}, "calc.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/calc"
+)
+
+type impl struct{}
+
+func (impl) Func(args *calc.Number, reply *calc.Number) error {
+	reply.Value = -args.Value
+	return nil
+}
+
+func (impl) Range(args *calc.Number, stream calc.CalculatorRangeServer) error {
+	return stream.Send(args)
+}
+
+func main() {
+	var client calc.CalculatorClient = calc.NewCalculatorLocalClient(impl{})
+	reply := new(calc.Number)
+	fmt.Println(client.Func(&calc.Number{Value: 1}, reply), reply.Value)
+	r, _ := client.Range(&calc.Number{Value: 2})
+	n, err := r.Recv()
+	fmt.Println(err, n.Value)
+}
+`)
+	if output != "<nil> -1\n<nil> 2" {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestClient(t *testing.T) {
+	for _, encode := range []string{"", "json"} {
+		dir := generate(t, map[string]string{"greeter.dgen": greeterIDL}, "greeter.dgen", config.CodegenConfig{EncodeType: encode})
+
+		output := run(t, dir, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/greeter"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+func (impl) SayHello(args *greeter.HelloRequest, reply *greeter.HelloResponse) error {
+	if args.Name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	reply.Reply = "hello " + args.Name
+	return nil
+}
+
+func (impl) Notify(args *greeter.HelloRequest) error {
+	fmt.Println("notified", args.Name)
+	return nil
+}
+
+func main() {
+	s := drpc.NewServer()
+	greeter.RegisterGreeterService(s, "greeter", impl{})
+
+	var client greeter.GreeterClient = greeter.NewGreeterClient(drpc.NewClient(s), "greeter")
+	reply := new(greeter.HelloResponse)
+	fmt.Println(client.SayHello(&greeter.HelloRequest{Name: "dgen"}, reply), reply.Reply)
+	fmt.Println(client.SayHello(&greeter.HelloRequest{Name: "x"}, reply), reply.Reply)
+	fmt.Println(client.Notify(&greeter.HelloRequest{Name: "dgen"}))
+}
+`)
+		want := "<nil> hello dgen\n<nil> hello x\nnotified dgen\n<nil>"
+		if output != want {
+			t.Errorf("encode %q: unexpected output:\n%s\nwant:\n%s", encode, output, want)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	dir := generate(t, map[string]string{"greeter.dgen": greeterIDL}, "greeter.dgen", config.CodegenConfig{Context: true})
+
+	output := run(t, dir, `package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"example.com/gen/greeter"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+var done = make(chan error, 1)
+
+func (impl) SayHello(ctx context.Context, args *greeter.HelloRequest, reply *greeter.HelloResponse) error {
+	switch args.Name {
+	case "slow":
+		// the deadline of the client is carried over to the handler
+		select {
+		case <-ctx.Done():
+			done <- ctx.Err()
+		case <-time.After(time.Second):
+			done <- nil
+		}
+	case "deadline":
+		deadline, ok := ctx.Deadline()
+		reply.Reply = fmt.Sprint(ok, time.Until(deadline) > 0 && time.Until(deadline) <= time.Hour)
+		return nil
+	}
+	reply.Reply = "hello " + args.Name
+	return nil
+}
+
+func (impl) Notify(ctx context.Context, args *greeter.HelloRequest) error {
+	fmt.Println("notified", args.Name, ctx != nil)
+	return nil
+}
+
+func main() {
+	s := drpc.NewServer()
+	greeter.RegisterGreeterService(s, "greeter", impl{})
+	client := greeter.NewGreeterClient(drpc.NewClient(s), "greeter")
+
+	reply := new(greeter.HelloResponse)
+	fmt.Println(client.SayHello(context.Background(), &greeter.HelloRequest{Name: "dgen"}, reply), reply.Reply)
+	fmt.Println(client.Notify(context.Background(), &greeter.HelloRequest{Name: "dgen"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	fmt.Println(client.SayHello(ctx, &greeter.HelloRequest{Name: "slow"}, reply))
+	fmt.Println("handler", <-done)
+
+	client.SayHello(context.Background(), &greeter.HelloRequest{Name: "deadline"}, reply)
+	fmt.Println(reply.Reply)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	client.SayHello(ctx, &greeter.HelloRequest{Name: "deadline"}, reply)
+	cancel()
+	fmt.Println(reply.Reply)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	fmt.Println(client.Notify(ctx, &greeter.HelloRequest{Name: "canceled"}))
+}
+`)
+	want := "<nil> hello dgen\nnotified dgen true\n<nil>\ncontext deadline exceeded\nhandler context deadline exceeded\nfalse false\ntrue true\ncontext canceled"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	dir := generate(t, map[string]string{"greeter.dgen": greeterIDL}, "greeter.dgen", config.CodegenConfig{Context: true})
+
+	output := run(t, dir, `package main
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/gen/greeter"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+func (impl) SayHello(ctx context.Context, args *greeter.HelloRequest, reply *greeter.HelloResponse) error {
+	md, ok := greeter.FromIncomingContext(ctx)
+	_, outgoing := greeter.FromOutgoingContext(ctx)
+	reply.Reply = fmt.Sprintf("%v %v %d %q %q", ok, outgoing, len(md), md["token"], md["trace-id"])
+	return nil
+}
+
+func (impl) Notify(ctx context.Context, args *greeter.HelloRequest) error {
+	md, _ := greeter.FromIncomingContext(ctx)
+	fmt.Println("notified", md)
+	return nil
+}
+
+func main() {
+	s := drpc.NewServer()
+	greeter.RegisterGreeterService(s, "greeter", impl{})
+	client := greeter.NewGreeterClient(drpc.NewClient(s), "greeter")
+
+	reply := new(greeter.HelloResponse)
+	client.SayHello(context.Background(), &greeter.HelloRequest{Name: "dgen"}, reply)
+	fmt.Println(reply.Reply)
+
+	ctx := greeter.NewOutgoingContext(context.Background(), greeter.Metadata{"token": "secret", "trace-id": "42"})
+	client.SayHello(ctx, &greeter.HelloRequest{Name: "dgen"}, reply)
+	fmt.Println(reply.Reply)
+	client.Notify(ctx, &greeter.HelloRequest{Name: "dgen"})
+
+	_, err := drpc.NewClient(s).Call("greeter.SayHello", []byte{1})
+	fmt.Println(err)
+}
+`)
+	want := "true false 0 \"\" \"\"\ntrue false 2 \"secret\" \"42\"\nnotified map[token:secret trace-id:42]\ninvalid request metadata"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	dir := generate(t, map[string]string{"greeter.dgen": greeterIDL}, "greeter.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/gen/greeter"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+func (impl) SayHello(args *greeter.HelloRequest, reply *greeter.HelloResponse) error {
+	fmt.Println("handle", args.Name)
+	reply.Reply = "hello " + args.Name
+	return nil
+}
+
+func (impl) Notify(args *greeter.HelloRequest) error {
+	return nil
+}
+
+func logger(name string) greeter.Interceptor {
+	return func(method string, args, reply interface{}, invoker greeter.Invoker) error {
+		fmt.Println(name, "before", method)
+		err := invoker(args, reply)
+		fmt.Println(name, "after", method, err)
+		return err
+	}
+}
+
+func auth(method string, args, reply interface{}, invoker greeter.Invoker) error {
+	if args.(*greeter.HelloRequest).Name == "guest" {
+		return errors.New("unauthenticated")
+	}
+	return invoker(args, reply)
+}
+
+func main() {
+	s := drpc.NewServer()
+	greeter.RegisterGreeterService(s, "greeter", impl{}, logger("server1"), logger("server2"), auth)
+	client := greeter.NewGreeterClient(drpc.NewClient(s), "greeter", logger("client"))
+
+	reply := new(greeter.HelloResponse)
+	fmt.Println(client.SayHello(&greeter.HelloRequest{Name: "dgen"}, reply), reply.Reply)
+	fmt.Println(client.Notify(&greeter.HelloRequest{Name: "guest"}))
+}
+`)
+	want := strings.Join([]string{
+		"client before greeter.SayHello",
+		"server1 before greeter.SayHello",
+		"server2 before greeter.SayHello",
+		"handle dgen",
+		"server2 after greeter.SayHello <nil>",
+		"server1 after greeter.SayHello <nil>",
+		"client after greeter.SayHello <nil>",
+		"<nil> hello dgen",
+		"client before greeter.Notify",
+		"server1 before greeter.Notify",
+		"server2 before greeter.Notify",
+		"server2 after greeter.Notify unauthenticated",
+		"server1 after greeter.Notify unauthenticated",
+		"client after greeter.Notify <nil>",
+		"<nil>",
+	}, "\n")
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestThrows(t *testing.T) {
+	for _, encodeType := range []string{"", "json"} {
+		dir := generate(t, map[string]string{
+			"store.dgen": `
+import "common.dgen";
+
+message GetRequest {
+	seq=1 string key;
+}
+
+message GetResponse {
+	seq=1 string value;
+}
+
+message InvalidKey {
+	seq=1 string key;
+	seq=2 string reason;
+	optional seq=3 int32 position;
+	optional seq=4 list[GetRequest] related;
+	optional seq=5 map[int32]string notes;
+}
+
+service Store {
+	Get(GetRequest) return (GetResponse) throws (NotFound, InvalidKey);
+}
+`,
+			"common.dgen": `
+message NotFound {
+	seq=1 string key;
+}
+`,
+		}, "store.dgen", config.CodegenConfig{EncodeType: encodeType})
+
+		output := run(t, dir, `package main
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/gen/common"
+	"example.com/gen/store"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+func (impl) Get(args *store.GetRequest, reply *store.GetResponse) error {
+	switch args.Key {
+	case "missing":
+		return &common.NotFound{Key: args.Key}
+	case "a b":
+		position := int32(1)
+		return fmt.Errorf("get: %w", &store.InvalidKey{
+			Key:      args.Key,
+			Reason:   "space",
+			Position: &position,
+			Related:  []*store.GetRequest{{Key: "a"}},
+			Notes:    map[int32]string{10: "x", 9: "y"},
+		})
+	case "broken":
+		return errors.New("disk failure")
+	}
+	reply.Value = "value of " + args.Key
+	return nil
+}
+
+func main() {
+	s := drpc.NewServer()
+	store.RegisterStoreService(s, "store", impl{})
+	client := store.NewStoreClient(drpc.NewClient(s), "store")
+
+	for _, key := range []string{"a", "missing", "a b", "broken"} {
+		reply := new(store.GetResponse)
+		err := client.Get(&store.GetRequest{Key: key}, reply)
+
+		var notFound *common.NotFound
+		var invalid *store.InvalidKey
+		switch {
+		case errors.As(err, &notFound):
+			fmt.Println("not found", notFound.Key)
+		case errors.As(err, &invalid):
+			fmt.Println("invalid", invalid.Reason, invalid)
+		default:
+			fmt.Println(err, reply.Value)
+		}
+	}
+}
+`)
+		want := "<nil> value of a\nnot found missing\ninvalid space InvalidKey{Key:a b Reason:space Position:1 Related:[{Key:a}] Notes:map[9:y 10:x]}\ndisk failure"
+		if output != want {
+			t.Errorf("%q: unexpected output:\n%s\nwant:\n%s", encodeType, output, want)
+		}
+	}
+}
+
+const streamIDL = `
+message Number {
+	seq=1 int32 value;
+}
+
+service Calculator {
+	Range(Number) return (stream Number);
+	Sum(stream Number) return (Number);
+	Double(stream Number) return (stream Number);
+}
+`
+
+func TestStream(t *testing.T) {
+	dir := generate(t, map[string]string{"calc.dgen": streamIDL}, "calc.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"example.com/gen/calc"
+	"example.com/memstream"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+func (impl) Range(args *calc.Number, stream calc.CalculatorRangeServer) error {
+	if args.Value < 0 {
+		return errors.New("negative")
+	}
+	for i := int32(1); i <= args.Value; i++ {
+		if err := stream.Send(&calc.Number{Value: i}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (impl) Sum(stream calc.CalculatorSumServer, reply *calc.Number) error {
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply.Value += n.Value
+	}
+}
+
+func (impl) Double(stream calc.CalculatorDoubleServer) error {
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&calc.Number{Value: n.Value * 2}); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	s := drpc.NewServer()
+	streams := memstream.New()
+	calc.RegisterCalculatorService(s, streams, "calc", impl{})
+	client := calc.NewCalculatorClient(drpc.NewClient(s), streams, "calc")
+
+	r, err := client.Range(&calc.Number{Value: 3})
+	if err != nil {
+		panic(err)
+	}
+	for {
+		n, err := r.Recv()
+		if err != nil {
+			fmt.Println("range", err)
+			break
+		}
+		fmt.Println("range", n.Value)
+	}
+	r, _ = client.Range(&calc.Number{Value: -1})
+	fmt.Println(r.Recv())
+
+	sum, err := client.Sum()
+	if err != nil {
+		panic(err)
+	}
+	for i := int32(1); i <= 4; i++ {
+		sum.Send(&calc.Number{Value: i})
+	}
+	total := new(calc.Number)
+	fmt.Println("sum", sum.CloseAndRecv(total), total.Value)
+
+	double, err := client.Double()
+	if err != nil {
+		panic(err)
+	}
+	for i := int32(1); i <= 2; i++ {
+		double.Send(&calc.Number{Value: i})
+		n, _ := double.Recv()
+		fmt.Println("double", n.Value)
+	}
+	double.CloseSend()
+	_, err = double.Recv()
+	fmt.Println("double", err)
+}
+`)
+	want := "range 1\nrange 2\nrange 3\nrange EOF\n<nil> negative\nsum <nil> 10\ndouble 2\ndouble 4\ndouble EOF"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	dir := generate(t, map[string]string{"calc.dgen": streamIDL}, "calc.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"example.com/gen/calc"
+	"example.com/memstream"
+	"github.com/fengluodb/drpc"
+)
+
+type impl struct{}
+
+func (impl) Range(args *calc.Number, stream calc.CalculatorRangeServer) error {
+	return stream.Send(&calc.Number{Value: args.Value})
+}
+
+func (impl) Sum(stream calc.CalculatorSumServer, reply *calc.Number) error {
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply.Value += n.Value
+	}
+}
+
+func (impl) Double(stream calc.CalculatorDoubleServer) error {
+	return nil
+}
+
+func logger(side string) calc.Interceptor {
+	return func(method string, args, reply interface{}, invoker calc.Invoker) error {
+		fmt.Printf("%s %s %T %T\n", side, method, args, reply)
+		return invoker(args, reply)
+	}
+}
+
+func deny(method string, args, reply interface{}, invoker calc.Invoker) error {
+	if method == "calc.Double" {
+		return errors.New("denied")
+	}
+	return invoker(args, reply)
+}
+
+func main() {
+	s := drpc.NewServer()
+	streams := memstream.New()
+	calc.RegisterCalculatorService(s, streams, "calc", impl{}, logger("server"))
+	client := calc.NewCalculatorClient(drpc.NewClient(s), streams, "calc", logger("client"), deny)
+
+	r, err := client.Range(&calc.Number{Value: 3})
+	if err != nil {
+		panic(err)
+	}
+	n, err := r.Recv()
+	fmt.Println(n.Value, err)
+
+	sum, err := client.Sum()
+	if err != nil {
+		panic(err)
+	}
+	sum.Send(&calc.Number{Value: 4})
+	total := new(calc.Number)
+	fmt.Println(sum.CloseAndRecv(total), total.Value)
+
+	_, err = client.Double()
+	fmt.Println(err)
+}
+`)
+	want := "client calc.Range *calc.Number <nil>\n" +
+		"server calc.Range *calc.Number <nil>\n" +
+		"3 <nil>\n" +
+		"client calc.Sum <nil> <nil>\n" +
+		"server calc.Sum *calc.calculatorSumServer *calc.Number\n" +
+		"<nil> 4\n" +
+		"client calc.Double <nil> <nil>\n" +
+		"denied"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	dir := generate(t, map[string]string{"calc.dgen": streamIDL}, "calc.dgen", config.CodegenConfig{Context: true})
+
+	output := run(t, dir, `package main
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/gen/calc"
+	"example.com/memstream"
+	"github.com/fengluodb/drpc"
+)
+
+var doubled = make(chan error, 1)
+
+type impl struct{}
+
+func (impl) Range(ctx context.Context, args *calc.Number, stream calc.CalculatorRangeServer) error {
+	md, _ := calc.FromIncomingContext(ctx)
+	fmt.Println("range", md["token"], args.Value)
+	return nil
+}
+
+func (impl) Sum(ctx context.Context, stream calc.CalculatorSumServer, reply *calc.Number) error {
+	return nil
+}
+
+func (impl) Double(ctx context.Context, stream calc.CalculatorDoubleServer) error {
+	for {
+		n, err := stream.Recv()
+		if err != nil {
+			doubled <- err
+			return err
+		}
+		if err := stream.Send(&calc.Number{Value: n.Value * 2}); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	s := drpc.NewServer()
+	streams := memstream.New()
+	calc.RegisterCalculatorService(s, streams, "calc", impl{})
+	client := calc.NewCalculatorClient(drpc.NewClient(s), streams, "calc")
+
+	ctx := calc.NewOutgoingContext(context.Background(), calc.Metadata{"token": "secret"})
+	r, err := client.Range(ctx, &calc.Number{Value: 3})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(r.Recv())
+
+	// the call is canceled with its ctx, the blocked handler is released
+	dctx, cancel := context.WithCancel(ctx)
+	double, err := client.Double(dctx)
+	if err != nil {
+		panic(err)
+	}
+	double.Send(&calc.Number{Value: 2})
+	n, _ := double.Recv()
+	fmt.Println("double", n.Value)
+	cancel()
+	fmt.Println(<-doubled)
+	_, err = double.Recv()
+	fmt.Println(err)
+
+	fmt.Println(client.Double(dctx))
+}
+`)
+	want := "range secret 3\n<nil> EOF\ndouble 4\nstream canceled by the client\nstream canceled by the client\n<nil> context canceled"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestMock(t *testing.T) {
+	dir := generate(t, map[string]string{"greeter.dgen": greeterIDL}, "greeter.dgen", config.CodegenConfig{Mock: true})
+
+	output := run(t, dir, `package main
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/gen/greeter"
+	"github.com/fengluodb/drpc"
+)
+
+func main() {
+	mock := new(greeter.MockGreeter)
+	mock.StubSayHello(&greeter.HelloResponse{Reply: "stubbed"}, nil)
+	mock.StubNotify(errors.New("notify failed"))
+
+	// the mock is both a service and a client
+	var client greeter.GreeterClient = mock
+	reply := new(greeter.HelloResponse)
+	fmt.Println(client.SayHello(&greeter.HelloRequest{Name: "a"}, reply), reply.Reply)
+	fmt.Println(client.Notify(&greeter.HelloRequest{Name: "b"}))
+
+	s := drpc.NewServer()
+	greeter.RegisterGreeterService(s, "greeter", mock)
+	mock.SayHelloFunc = func(args *greeter.HelloRequest, reply *greeter.HelloResponse) error {
+		reply.Reply = "hello " + args.Name
+		return nil
+	}
+	greeter.NewGreeterClient(drpc.NewClient(s), "greeter").SayHello(&greeter.HelloRequest{Name: "c"}, reply)
+	fmt.Println(reply.Reply)
+
+	for _, call := range mock.Calls() {
+		fmt.Println(call.Method, call.Args.(*greeter.HelloRequest).Name)
+	}
+}
+`)
+	want := "<nil> stubbed\nnotify failed\nhello c\nSayHello a\nNotify b\nSayHello c"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+
+	dir = generate(t, map[string]string{"calc.dgen": streamIDL}, "calc.dgen", config.CodegenConfig{Context: true, Mock: true})
+	output = run(t, dir, `package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"example.com/gen/calc"
+)
+
+func main() {
+	mock := new(calc.MockCalculator)
+	mock.StubSum(nil, errors.New("unavailable"))
+
+	var client calc.CalculatorClient = mock
+	fmt.Println(client.Sum(context.Background()))
+	fmt.Println(client.Range(context.Background(), &calc.Number{Value: 1}))
+	fmt.Println(len(mock.Calls()), mock.Calls()[0].Method)
+
+	// the service with streaming methods is mocked by MockCalculatorServer
+	ctx := context.Background()
+	server := new(calc.MockCalculatorServer)
+	server.StubSum(&calc.Number{Value: 7}, nil)
+	server.RangeFunc = func(_ context.Context, args *calc.Number, stream calc.CalculatorRangeServer) error {
+		return stream.Send(args)
+	}
+	server.StubDouble(errors.New("down"))
+	local := calc.NewCalculatorLocalClient(server)
+
+	sum, _ := local.Sum(ctx)
+	total := new(calc.Number)
+	fmt.Println(sum.CloseAndRecv(total), total.Value)
+	r, _ := local.Range(ctx, &calc.Number{Value: 5})
+	n, _ := r.Recv()
+	fmt.Println(n.Value)
+	double, _ := local.Double(ctx)
+	_, err := double.Recv()
+	fmt.Println(err)
+	for _, call := range server.Calls() {
+		fmt.Println(call.Method, call.Args != nil)
+	}
+}
+`)
+	want = "<nil> unavailable\n<nil> <nil>\n2 Sum\n<nil> 7\n5\ndown\nSum false\nRange true\nDouble false"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestLocalClient(t *testing.T) {
+	dir := generate(t, map[string]string{"calc.dgen": `
+message Number {
+	seq=1 int32 value;
+}
+
+service Calculator {
+	Square(Number) return (Number);
+	Range(Number) return (stream Number);
+	Sum(stream Number) return (Number);
+}
+`}, "calc.dgen", config.CodegenConfig{})
+
+	output := run(t, dir, `package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"example.com/gen/calc"
+)
+
+var ranged = make(chan error, 1)
+
+type impl struct{}
+
+func (impl) Square(args *calc.Number, reply *calc.Number) error {
+	if args.Value > 100 {
+		return errors.New("too large")
+	}
+	reply.Value = args.Value * args.Value
+	return nil
+}
+
+func (impl) Range(args *calc.Number, stream calc.CalculatorRangeServer) error {
+	for i := int32(1); i <= args.Value; i++ {
+		if err := stream.Send(&calc.Number{Value: i}); err != nil {
+			ranged <- err
+			return err
+		}
+	}
+	return nil
+}
+
+func (impl) Sum(stream calc.CalculatorSumServer, reply *calc.Number) error {
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply.Value += n.Value
+	}
+}
+
+func main() {
+	client := calc.NewCalculatorLocalClient(impl{})
+
+	reply := new(calc.Number)
+	fmt.Println(client.Square(&calc.Number{Value: 3}, reply), reply.Value)
+	fmt.Println(client.Square(&calc.Number{Value: 101}, reply))
+	// the request is marshalled, and the required zero value is kept
+	fmt.Println(client.Square(&calc.Number{}, reply), reply.Value)
+
+	r, _ := client.Range(&calc.Number{Value: 2})
+	for {
+		n, err := r.Recv()
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		fmt.Println(n.Value)
+	}
+
+	// the stream can be closed more than once, and Send fails after it
+	sum, _ := client.Sum()
+	sum.Send(&calc.Number{Value: 2})
+	total := new(calc.Number)
+	fmt.Println(sum.CloseAndRecv(total), total.Value)
+	fmt.Println(sum.CloseAndRecv(total), sum.Send(&calc.Number{Value: 1}))
+
+	// the handler sending more than the client reads is released once the
+	// client closes the stream
+	r, _ = client.Range(&calc.Number{Value: 100})
+	r.Recv()
+	fmt.Println(r.Close(), r.Close())
+	fmt.Println(<-ranged)
+	_, err := r.Recv()
+	fmt.Println(err)
+}
+`)
+	want := "<nil> 9\ntoo large\n<nil> 0\n1\n2\nEOF\n<nil> 2\nEOF send on closed stream\n<nil> <nil>\nstream canceled by the client\nstream canceled by the client"
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	for _, encodeType := range []string{"", "json"} {
+		dir := generate(t, map[string]string{"users.dgen": `
+enum role {
+	admin,
+	guest
+}
+
+message GetUser {
+	seq=1 string name;
+	optional seq=2 int32 age;
+	optional seq=3 role role;
+}
+
+message User {
+	seq=1 string name;
+	optional seq=2 int32 age;
+	optional seq=3 role role;
+}
+
+message NotFound {
+	seq=1 string name;
+}
+
+service Users {
+	Get(GetUser) return (User) throws (NotFound) [http_method = "GET", http_path = "/users"];
+	Save(User) [http_method = "PUT", http_path = "/users"];
+	Echo(User) return (User);
+}
+`}, "users.dgen", config.CodegenConfig{EncodeType: encodeType, Gateway: true})
+
+		output := run(t, dir, `package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"example.com/gen/users"
+)
+
+type impl struct{}
+
+func (impl) Get(args *users.GetUser, reply *users.User) error {
+	if args.Name == "nobody" {
+		return &users.NotFound{Name: args.Name}
+	}
+	reply.Name, reply.Age, reply.Role = args.Name, args.Age, args.Role
+	return nil
+}
+
+func (impl) Save(args *users.User) error {
+	fmt.Println("saved", args.Name, args.Role)
+	return nil
+}
+
+func (impl) Echo(args *users.User, reply *users.User) error {
+	*reply = *args
+	return nil
+}
+
+func main() {
+	server := httptest.NewServer(users.NewUsersGateway(impl{}))
+	defer server.Close()
+
+	do := func(method, path, body string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		fmt.Println(resp.StatusCode, resp.Header.Get("Allow"), strings.TrimSpace(string(data)))
+	}
+
+	do("GET", "/users?name=dgen&age=3&role=Guest", "")
+	do("GET", "/users?name=nobody", "")
+	do("GET", "/users?name=dgen&age=x", "")
+	do("PUT", "/users", `+"`"+`{"Name": "dgen", "Role": "Admin"}`+"`"+`)
+	do("POST", "/Users/Echo", `+"`"+`{"name": "dgen", "age": 5}`+"`"+`)
+	do("POST", "/Users/Echo", "{")
+	do("POST", "/users", "")
+	do("GET", "/Users/Get", "")
+}
+`)
+		want := strings.Join([]string{
+			`200  {"Name":"dgen","Age":3,"Role":"Guest"}`,
+			`400  {"error":"NotFound","detail":{"Name":"nobody"}}`,
+			`400  {"error":"invalid query parameter age: strconv.ParseInt: parsing \"x\": invalid syntax"}`,
+			`saved dgen Admin`,
+			`204  `,
+			`200  {"Name":"dgen","Age":5}`,
+			`400  {"error":"invalid request body: unexpected EOF"}`,
+			`405 GET, PUT {"error":"method not allowed"}`,
+			`404  {"error":"not found"}`,
+		}, "\n")
+		if output != want {
+			t.Errorf("%q: unexpected output:\n%s\nwant:\n%s", encodeType, output, want)
+		}
+	}
+}
+
+func TestGatewayRequired(t *testing.T) {
+	dir := generate(t, map[string]string{"shop.dgen": `
+message Item {
+	seq=1 string name;
+	optional seq=2 int32 count;
+}
+
+message Order {
+	seq=1 string id;
+	seq=2 Item first;
+	optional seq=3 list[Item] items;
+	optional seq=4 map[string]list[Item] groups;
+}
+
+message Query {
+	seq=1 string id;
+	optional seq=2 int32 limit;
+}
+
+message Batch {
+	seq=1 string id;
+	seq=2 list[string] tags;
+}
+
+service Shop {
+	Place(Order);
+	Find(Query) [http_method = "GET", http_path = "/orders"];
+	Remove(Batch) [http_method = "DELETE", http_path = "/orders"];
+}
+`}, "shop.dgen", config.CodegenConfig{Gateway: true})
+
+	output := run(t, dir, `package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"example.com/gen/shop"
+)
+
+type impl struct{}
+
+func (impl) Place(args *shop.Order) error {
+	fmt.Println("placed", args.Id, args.First.Name, len(args.Items))
+	return nil
+}
+
+func (impl) Find(args *shop.Query) error {
+	fmt.Println("found", args.Id)
+	return nil
+}
+
+func (impl) Remove(args *shop.Batch) error {
+	return nil
+}
+
+func main() {
+	shop.MaxGatewayBodySize = 256
+	server := httptest.NewServer(shop.NewShopGateway(impl{}))
+	defer server.Close()
+
+	do := func(method, path, body string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		fmt.Println(resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	do("POST", "/Shop/Place", `+"`"+`{"id": "1", "first": {"name": "a"}, "items": [{"name": "b", "count": 2}]}`+"`"+`)
+	do("POST", "/Shop/Place", "")
+	do("POST", "/Shop/Place", `+"`"+`{"id": "1"}`+"`"+`)
+	do("POST", "/Shop/Place", `+"`"+`{"id": "1", "first": null}`+"`"+`)
+	do("POST", "/Shop/Place", `+"`"+`{"id": "1", "first": {}}`+"`"+`)
+	do("POST", "/Shop/Place", `+"`"+`{"id": "1", "first": {"name": "a"}, "items": [{"name": "b"}, {"count": 1}]}`+"`"+`)
+	do("POST", "/Shop/Place", `+"`"+`{"id": "1", "first": {"name": "a"}, "groups": {"x": [{}]}}`+"`"+`)
+	do("POST", "/Shop/Place", `+"`"+`{"id": "`+"`"+`+strings.Repeat("x", 300)+`+"`"+`"}`+"`"+`)
+	do("GET", "/orders?id=1", "")
+	do("GET", "/orders?limit=1", "")
+	do("DELETE", "/orders?id=1", "")
+}
+`)
+	want := strings.Join([]string{
+		`placed 1 a 1`,
+		`204 `,
+		`400 {"error":"invalid request body: missing required field Id"}`,
+		`400 {"error":"invalid request body: missing required field First"}`,
+		`400 {"error":"invalid request body: missing required field First"}`,
+		`400 {"error":"invalid request body: missing required field First.Name"}`,
+		`400 {"error":"invalid request body: missing required field Items[1].Name"}`,
+		`400 {"error":"invalid request body: missing required field Groups[\"x\"][0].Name"}`,
+		`413 {"error":"request body too large"}`,
+		`found 1`,
+		`204 `,
+		`400 {"error":"missing query parameter id"}`,
+		`400 {"error":"missing required field Tags"}`,
+	}, "\n")
+	if output != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+}
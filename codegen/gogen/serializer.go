@@ -29,16 +29,22 @@ func (g *Gogen) genSerializerFunction(w io.Writer) error {
 		buf.WriteString("\tdata := []byte{}\n\n")
 
 		for _, m := range v.Members {
-			if m.Type == "uint8" || m.Type == "uint16" || m.Type == "uint32" || m.Type == "uint64" ||
-				m.Type == "int8" || m.Type == "int16" || m.Type == "int32" || m.Type == "int64" {
-				buf.WriteString(fmt.Sprintf("\tif x.%s != 0 {\n", m.Name))
-			} else if m.Type == "string" {
-				buf.WriteString(fmt.Sprintf("\tif x.%s != \"\" {\n", m.Name))
-			} else {
-				buf.WriteString(fmt.Sprintf("\tif x.%s != nil {\n", m.Name))
+			// the required scalar is always encoded, even if it is zero, and the
+			// optional scalar is encoded if it is set
+			if m.Scalar {
+				if m.Optional {
+					buf.WriteString(fmt.Sprintf("\tif x.%s != nil {\n", m.Name))
+					g.genAppendField(w, buf, v.Name, m, "*x."+m.Name, "\t\t")
+					buf.WriteString("\t}\n\n")
+				} else {
+					g.genAppendField(w, buf, v.Name, m, "x."+m.Name, "\t")
+					buf.WriteString("\n")
+				}
+				continue
 			}
-			buf.WriteString(fmt.Sprintf("\t\tdata = append(data, MarshalUint8(%d)...)\n", m.Seq))
-			buf.WriteString(fmt.Sprintf("\t\tdata = append(data, Marshal%s(x.%s)...)\n", g.genTypeSerialization(w, m.Type), m.Name))
+
+			buf.WriteString(fmt.Sprintf("\tif x.%s != nil {\n", m.Name))
+			g.genAppendField(w, buf, v.Name, m, "x."+m.Name, "\t\t")
 			if !m.Optional {
 				buf.WriteString("\t}")
 				buf.WriteString(" else {\n")
@@ -53,24 +59,72 @@ func (g *Gogen) genSerializerFunction(w io.Writer) error {
 	}
 
 	for _, v := range g.StructStats {
+		buf.WriteString("// Unmarshal decodes data with DefaultDecodeOptions\n")
 		buf.WriteString(fmt.Sprintf("func (x *%s) Unmarshal(data []byte) error {\n", v.Name))
-		buf.WriteString("\tr := bytes.NewReader(data)\n\n")
-		buf.WriteString("\tseq := UnmarshalUint8(r)\n")
-
-		for i, m := range v.Members {
-			buf.WriteString(fmt.Sprintf("\t if seq == %d {\n", m.Seq))
-			buf.WriteString(fmt.Sprintf("\t\tx.%s = Unmarshal%s(r)\n", m.Name, g.genTypeSerialization(w, m.Type)))
-			if i != len(v.Members)-1 {
-				buf.WriteString("\t\tseq = UnmarshalUint8(r)\n")
+		buf.WriteString("\treturn x.UnmarshalWithOptions(data, DefaultDecodeOptions)\n")
+		buf.WriteString("}\n\n")
+
+		// the fields may come in any order, and the fields unknown to this
+		// schema, e.g. added by a newer one, are skipped by their length
+		buf.WriteString(fmt.Sprintf("func (x *%s) UnmarshalWithOptions(data []byte, opts DecodeOptions) error {\n", v.Name))
+		buf.WriteString("\tr, err := newDecoder(data, opts)\n")
+		buf.WriteString("\tif err != nil {\n")
+		buf.WriteString("\t\treturn err\n")
+		buf.WriteString("\t}\n")
+		if len(v.Members) != 0 {
+			buf.WriteString("\tfield := &decoder{opts: opts}\n")
+		}
+		for _, m := range v.Members {
+			if !m.Optional {
+				buf.WriteString(fmt.Sprintf("\thas%s := false\n", m.Name))
 			}
+		}
+		buf.WriteString("\n")
+		buf.WriteString("\tfor {\n")
+		buf.WriteString("\t\tseq, err := readSeq(r)\n")
+		buf.WriteString("\t\tif err != nil {\n")
+		buf.WriteString("\t\t\treturn err\n")
+		buf.WriteString("\t\t}\n")
+		buf.WriteString("\t\tif seq == -1 {\n")
+		buf.WriteString("\t\t\tbreak\n")
+		buf.WriteString("\t\t}\n")
+		buf.WriteString("\n")
+		buf.WriteString("\t\tswitch seq {\n")
+		for _, m := range v.Members {
+			buf.WriteString(fmt.Sprintf("\t\tcase %d:\n", m.Seq))
+			target, expr := "x."+m.Name, "x."+m.Name
+			buf.WriteString("\t\t\tif field.data, err = readBytes(r, 0); err == nil {\n")
+			if m.Pointer() {
+				target, expr = "*x."+m.Name, "(*x."+m.Name+")"
+				buf.WriteString(fmt.Sprintf("\t\t\t\tx.%s = new(%s)\n", m.Name, m.Type))
+			}
+			buf.WriteString(fmt.Sprintf("\t\t\t\t%s, err = Unmarshal%s(field)\n", target, g.genTypeSerialization(w, m.Type)))
+			// the field must be consumed exactly, the trailing bytes mean the
+			// field is not encoded as the declared type
+			buf.WriteString("\t\t\t\tif err == nil && len(field.data) != 0 {\n")
+			buf.WriteString("\t\t\t\t\terr = fmt.Errorf(\"%d trailing bytes\", len(field.data))\n")
+			buf.WriteString("\t\t\t\t}\n")
+			buf.WriteString("\t\t\t}\n")
+			buf.WriteString("\t\t\tif err != nil {\n")
+			buf.WriteString(fmt.Sprintf("\t\t\t\treturn fmt.Errorf(\"unmarshal %s.%s failed: %%w\", err)\n", v.Name, m.Name))
+			buf.WriteString("\t\t\t}\n")
+			g.genEnumCheck(buf, expr, m.Type, v.Name+"."+m.Name, "\t\t\t", 0)
+			if !m.Optional {
+				buf.WriteString(fmt.Sprintf("\t\t\thas%s = true\n", m.Name))
+			}
+		}
+		buf.WriteString("\t\tdefault:\n")
+		buf.WriteString("\t\t\tif _, err := readBytes(r, 0); err != nil {\n")
+		buf.WriteString(fmt.Sprintf("\t\t\t\treturn fmt.Errorf(\"unmarshal %s failed, field %%d: %%w\", seq, err)\n", v.Name))
+		buf.WriteString("\t\t\t}\n")
+		buf.WriteString("\t\t}\n")
+		buf.WriteString("\t}\n\n")
 
+		for _, m := range v.Members {
 			if !m.Optional {
-				buf.WriteString("\t}")
-				buf.WriteString(" else {\n")
+				buf.WriteString(fmt.Sprintf("\tif !has%s {\n", m.Name))
 				buf.WriteString(fmt.Sprintf("\t\treturn fmt.Errorf(\"unmarshal failed, don't find %s\")\n", m.Name))
-				buf.WriteString("\t}\n\n")
-			} else {
-				buf.WriteString("\t}\n\n")
+				buf.WriteString("\t}\n")
 			}
 		}
 		buf.WriteString("\treturn nil\n")
@@ -82,14 +136,80 @@ func (g *Gogen) genSerializerFunction(w io.Writer) error {
 	return nil
 }
 
-func (g *Gogen) genJsonSerializerFunction(w io.Writer) error {
-	return jsonSerializerTmpl.Execute(w, g.parser)
+// genAppendField generates the code which appends the field holding expr to
+// data. The encoding of enums and messages may fail, e.g. an undeclared enum
+// value or a missing required field of the nested message, the error is
+// returned by Marshal.
+func (g *Gogen) genAppendField(w io.Writer, buf *bufio.Writer, message string, m *structMember, expr string, indent string) {
+	s := g.genTypeSerialization(w, m.Type)
+	if !g.fallible(m.Type) {
+		buf.WriteString(fmt.Sprintf("%sdata = appendField(data, %d, Marshal%s(%s))\n", indent, m.Seq, s, expr))
+		return
+	}
+	v := fmt.Sprintf("v%d", m.Seq)
+	buf.WriteString(fmt.Sprintf("%s%s, err := Marshal%s(%s)\n", indent, v, s, expr))
+	buf.WriteString(fmt.Sprintf("%sif err != nil {\n", indent))
+	buf.WriteString(fmt.Sprintf("%s\treturn nil, fmt.Errorf(\"marshal %s.%s failed: %%w\", err)\n", indent, message, m.Name))
+	buf.WriteString(fmt.Sprintf("%s}\n", indent))
+	buf.WriteString(fmt.Sprintf("%sdata = appendField(data, %d, %s)\n", indent, m.Seq, v))
+}
+
+// fallible reports whether the Marshal helper of typ returns an error, it is
+// the case for enums, messages, and the lists and maps of them.
+func (g *Gogen) fallible(typ string) bool {
+	if strings.HasPrefix(typ, "[]") {
+		return g.fallible(typ[2:])
+	}
+	if strings.HasPrefix(typ, "map") {
+		return g.fallible(typ[strings.Index(typ, "]")+1:])
+	}
+	return strings.HasPrefix(typ, "*") || g.containsEnum(typ)
+}
+
+// genEnumCheck generates the code which rejects the undeclared enum values
+// held by expr, including the elements of list and the values of map. field is
+// the field holding expr, like Reply.History.
+func (g *Gogen) genEnumCheck(buf *bufio.Writer, expr string, typ string, field string, indent string, depth int) {
+	if !g.containsEnum(typ) {
+		return
+	}
+
+	if strings.HasPrefix(typ, "[]") {
+		v := fmt.Sprintf("v%d", depth)
+		buf.WriteString(fmt.Sprintf("%sfor _, %s := range %s {\n", indent, v, expr))
+		g.genEnumCheck(buf, v, typ[2:], field, indent+"\t", depth+1)
+		buf.WriteString(indent + "}\n")
+	} else if strings.HasPrefix(typ, "map") {
+		v := fmt.Sprintf("v%d", depth)
+		buf.WriteString(fmt.Sprintf("%sfor _, %s := range %s {\n", indent, v, expr))
+		g.genEnumCheck(buf, v, typ[strings.Index(typ, "]")+1:], field, indent+"\t", depth+1)
+		buf.WriteString(indent + "}\n")
+	} else {
+		buf.WriteString(fmt.Sprintf("%sif !%s.IsValid() {\n", indent, expr))
+		buf.WriteString(fmt.Sprintf("%s\treturn fmt.Errorf(\"unmarshal %s failed: %%d is not a valid %s\", uint32(%s))\n", indent, field, typ[strings.LastIndex(typ, ".")+1:], expr))
+		buf.WriteString(indent + "}\n")
+	}
 }
 
-// avoid repeated generation
-var serializationMap = map[string]bool{}
+func (g *Gogen) containsEnum(typ string) bool {
+	if strings.HasPrefix(typ, "[]") {
+		return g.containsEnum(typ[2:])
+	}
+	if strings.HasPrefix(typ, "map") {
+		return g.containsEnum(typ[strings.Index(typ, "]")+1:])
+	}
+	_, ok := g.EnumMap[typ]
+	return ok
+}
+
+func (g *Gogen) genJsonSerializerFunction(w io.Writer) error {
+	return jsonSerializerTmpl.Execute(w, g)
+}
 
 func (g *Gogen) genTypeSerialization(w io.Writer, typ string) string {
+	if typ == "[]byte" {
+		return "Bytes"
+	}
 	if strings.HasPrefix(typ, "[]") {
 		return g.genListSerialization(w, typ)
 	} else if strings.HasPrefix(typ, "map") {
@@ -99,6 +219,10 @@ func (g *Gogen) genTypeSerialization(w io.Writer, typ string) string {
 	if idx := strings.LastIndex(typ, "*"); idx != -1 {
 		typ = typ[idx+1:]
 	}
+	// the type declared in an imported file is qualified by its package name
+	if idx := strings.LastIndex(typ, "."); idx != -1 {
+		typ = typ[idx+1:]
+	}
 	return utils.FirstUpper(typ)
 }
 
@@ -116,22 +240,45 @@ func MarshalList%s(v %s) []byte {
 	return data
 }
 `
+	if g.fallible(ele) {
+		tmpl1 = `
+func MarshalList%s(v %s) ([]byte, error) {
+	data := []byte{}
+
+	data = append(data, MarshalInt32(int32(len(v)))...)
+	for i, val := range v {
+		b, err := Marshal%s(val)
+		if err != nil {
+			return nil, fmt.Errorf("element %%d: %%w", i, err)
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+`
+	}
 	tmpl2 := `
-func UnmarshalList%s(r io.Reader) %s {
-	size := UnmarshalInt32(r)
+func UnmarshalList%s(r io.Reader) (%s, error) {
+	size, err := readSize(r, optionsOf(r).MaxCollectionSize)
+	if err != nil {
+		return nil, err
+	}
 	v := make(%s, 0)
-	var i int32
-	for i = 0; i < size; i++ {
-		v = append(v, Unmarshal%s(r))
+	for i := 0; i < size; i++ {
+		val, err := Unmarshal%s(r)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, val)
 	}
-	return v
+	return v, nil
 }
 
 `
-	if _, ok := serializationMap[typ]; !ok {
+	if _, ok := g.serializationMap[typ]; !ok {
 		w.Write([]byte(fmt.Sprintf(tmpl1, s, typ, s)))
 		w.Write([]byte(fmt.Sprintf(tmpl2, s, typ, typ, s)))
-		serializationMap[typ] = true
+		g.serializationMap[typ] = true
 	}
 	return "List" + s
 }
@@ -153,23 +300,49 @@ func MarshalMap%s%s(v %s) []byte {
 	return data
 }
 `
+	if g.fallible(val) {
+		tmpl1 = `
+func MarshalMap%s%s(v %s) ([]byte, error) {
+	data := []byte{}
+
+	data = append(data, MarshalInt32(int32(len(v)))...)
+	for key, val := range v {
+		data = append(data, Marshal%s(key)...)
+		b, err := Marshal%s(val)
+		if err != nil {
+			return nil, fmt.Errorf("value of %%v: %%w", key, err)
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+`
+	}
 	tmpl2 := `
-func UnmarshalMap%s%s(r io.Reader) %s {
-	size := UnmarshalInt32(r)
+func UnmarshalMap%s%s(r io.Reader) (%s, error) {
+	size, err := readSize(r, optionsOf(r).MaxCollectionSize)
+	if err != nil {
+		return nil, err
+	}
 	v := make(%s)
-	var i int32
-	for i = 0; i < size; i++ {
-		key := Unmarshal%s(r)
-		val := Unmarshal%s(r)
+	for i := 0; i < size; i++ {
+		key, err := Unmarshal%s(r)
+		if err != nil {
+			return nil, err
+		}
+		val, err := Unmarshal%s(r)
+		if err != nil {
+			return nil, err
+		}
 		v[key] = val
 	}
-	return v
+	return v, nil
 }
 `
-	if _, ok := serializationMap[typ]; !ok {
+	if _, ok := g.serializationMap[typ]; !ok {
 		w.Write([]byte(fmt.Sprintf(tmpl1, utils.FirstUpper(key), s, typ, utils.FirstUpper(key), s)))
 		w.Write([]byte(fmt.Sprintf(tmpl2, utils.FirstUpper(key), s, typ, typ, utils.FirstUpper(key), s)))
-		serializationMap[typ] = true
+		g.serializationMap[typ] = true
 	}
 
 	return "Map" + utils.FirstUpper(key) + s
@@ -0,0 +1,47 @@
+// Package drpc is an in-memory stand-in of github.com/fengluodb/drpc, it
+// only provides the API used by the generated code, so that the generated
+// code can be compiled and run by the tests.
+package drpc
+
+import "fmt"
+
+type Server struct {
+	handlers map[string]func(req []byte) ([]byte, error)
+}
+
+func NewServer() *Server {
+	return &Server{
+		handlers: make(map[string]func(req []byte) ([]byte, error)),
+	}
+}
+
+func RegisterService(s *Server, serviceMethod string, handler func(req []byte) ([]byte, error)) {
+	s.handlers[serviceMethod] = handler
+}
+
+// Client calls the handlers of the server directly
+type Client struct {
+	s *Server
+}
+
+func NewClient(s *Server) *Client {
+	return &Client{s: s}
+}
+
+func (c *Client) Call(serviceMethod string, req []byte) ([]byte, error) {
+	handler, ok := c.s.handlers[serviceMethod]
+	if !ok {
+		return nil, fmt.Errorf("service %s is not found", serviceMethod)
+	}
+	return handler(req)
+}
+
+// Notify sends the request without waiting for the response
+func (c *Client) Notify(serviceMethod string, req []byte) error {
+	handler, ok := c.s.handlers[serviceMethod]
+	if !ok {
+		return fmt.Errorf("service %s is not found", serviceMethod)
+	}
+	handler(req)
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/fengluodb/drpc
+
+go 1.19
@@ -0,0 +1,3 @@
+module example.com/memstream
+
+go 1.19
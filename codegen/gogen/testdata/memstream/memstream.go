@@ -0,0 +1,166 @@
+// Package memstream is an in-memory transport of the streaming methods, the
+// generated code declares the same Stream interface, so the tests can run the
+// streaming methods without network.
+package memstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Stream is the message stream of a streaming call
+type Stream = interface {
+	Send(data []byte) error
+	Recv() ([]byte, error)
+	CloseSend() error
+	Close() error
+}
+
+// Transport serves the streams registered to it, and starts the calls of them
+type Transport struct {
+	handlers map[string]func(stream Stream) error
+}
+
+func New() *Transport {
+	return &Transport{handlers: make(map[string]func(stream Stream) error)}
+}
+
+func (t *Transport) RegisterStream(serviceMethod string, handler func(stream Stream) error) {
+	t.handlers[serviceMethod] = handler
+}
+
+// Stream starts the streaming call, the handler runs in its own goroutine and
+// the stream is closed once it returns
+func (t *Transport) Stream(serviceMethod string) (Stream, error) {
+	handler, ok := t.handlers[serviceMethod]
+	if !ok {
+		return nil, fmt.Errorf("service %s is not found", serviceMethod)
+	}
+
+	c := &call{
+		requests:  make(chan []byte, 16),
+		responses: make(chan []byte, 16),
+		closed:    make(chan struct{}),
+		canceled:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		c.err = handler(&serverStream{c})
+		close(c.responses)
+		close(c.done)
+	}()
+	return &clientStream{call: c}, nil
+}
+
+var (
+	errClosed   = errors.New("send on closed stream")
+	errCanceled = errors.New("stream canceled by the client")
+)
+
+type call struct {
+	requests  chan []byte
+	responses chan []byte
+	closed    chan struct{} // closed by CloseSend of the client
+	canceled  chan struct{} // closed by Close of the client
+	done      chan struct{} // closed once the handler returns
+	err       error         // the error returned by the handler
+}
+
+type clientStream struct {
+	*call
+	closeOnce  sync.Once
+	cancelOnce sync.Once
+}
+
+func (s *clientStream) Send(data []byte) error {
+	select {
+	case <-s.canceled:
+		return errCanceled
+	default:
+	}
+	select {
+	case <-s.closed:
+		return errClosed
+	default:
+	}
+	select {
+	case s.requests <- data:
+		return nil
+	case <-s.done:
+		return io.EOF
+	case <-s.canceled:
+		return errCanceled
+	}
+}
+
+func (s *clientStream) Recv() ([]byte, error) {
+	select {
+	case <-s.canceled:
+		return nil, errCanceled
+	default:
+	}
+	select {
+	case data, ok := <-s.responses:
+		if !ok {
+			if s.err != nil {
+				return nil, s.err
+			}
+			return nil, io.EOF
+		}
+		return data, nil
+	case <-s.canceled:
+		return nil, errCanceled
+	}
+}
+
+func (s *clientStream) CloseSend() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *clientStream) Close() error {
+	s.cancelOnce.Do(func() { close(s.canceled) })
+	return nil
+}
+
+type serverStream struct {
+	*call
+}
+
+func (s *serverStream) Send(data []byte) error {
+	select {
+	case s.responses <- data:
+		return nil
+	case <-s.canceled:
+		return errCanceled
+	}
+}
+
+func (s *serverStream) Recv() ([]byte, error) {
+	select {
+	case data := <-s.requests:
+		return data, nil
+	case <-s.closed:
+		// the requests sent before CloseSend are received first
+		select {
+		case data := <-s.requests:
+			return data, nil
+		default:
+			return nil, io.EOF
+		}
+	case <-s.canceled:
+		return nil, errCanceled
+	}
+}
+
+// CloseSend does nothing, the stream is closed once the handler returns
+func (s *serverStream) CloseSend() error {
+	return nil
+}
+
+// Close does nothing, the stream is closed once the handler returns
+func (s *serverStream) Close() error {
+	return nil
+}
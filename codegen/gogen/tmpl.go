@@ -1,6 +1,10 @@
 package gogen
 
-import "text/template"
+import (
+	"dgen/utils"
+	"strings"
+	"text/template"
+)
 
 var (
 	header1Tmpl           = must(_header1Tmpl)
@@ -10,57 +14,142 @@ var (
 	structTmpl            = must(_structTmpl)
 	serviceTmpl           = must(_serviceTmpl)
 	registerTmpl          = must(_registerTmpl)
+	clientTmpl            = must(_clientTmpl)
+	contextTmpl           = must(_contextTmpl)
+	interceptorTmpl       = must(_interceptorTmpl)
+	mockTmpl              = must(_mockTmpl)
+	localTmpl             = must(_localTmpl)
+	gatewayTmpl           = must(_gatewayTmpl)
 	jsonSerializerTmpl    = must(_jsonSerializerTmpl)
 	defaultSerializerFunc = must(_defaultSerializerFunc)
 )
 
+var funcMap = template.FuncMap{
+	"firstLower": utils.FirstLower,
+	"add":        func(a, b int) int { return a + b },
+	"typeName":   typeName,
+}
+
 func must(s string) *template.Template {
-	return template.Must(template.New("").Parse(s))
+	return template.Must(template.New("").Funcs(funcMap).Parse(s))
+}
+
+// typeName returns the go type without the package name
+func typeName(typ string) string {
+	return typ[strings.LastIndex(typ, ".")+1:]
 }
 
 const _header1Tmpl = `package {{.Name}}
-{{if eq .EncodeType "json"}}
-import "encoding/json"
-{{ else }}
+
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-	"io"
-)
+{{- range .StdImports}}
+	"{{.}}"
 {{- end}}
+{{- if .Imports}}
+{{range .Imports}}
+	{{.}}
+{{- end}}
+{{- end}}
+)
 `
 
 const _header2Tmpl = `package {{.Name}}
 
-import "github.com/fengluodb/drpc"
+import (
+{{- range .ServiceStdImports}}
+	"{{.}}"
+{{- end}}
+{{- if .ServiceStdImports}}
+{{end}}
+	"github.com/fengluodb/drpc"
+{{- if .ServiceImports}}
+{{range .ServiceImports}}
+	{{.}}
+{{- end}}
+{{- end}}
+)
 
 `
 
 const _enumTmpl = `
 {{- range .EnumStats}}
+{{$name := .Name}}
 type {{.Name}} uint32
-{{end -}}
-`
 
-const _enumSerializationTmpl = `
-{{- range .EnumStats}}
-{{$name := .Name}}
 const(
-	{{- range $i,$v:=.Members}}
-	{{if eq $i 0}}{{$v}} {{$name}} = iota 
-	{{- else}}{{$v}} 
-	{{- end}}
+	{{- range .Members}}
+	{{.Name}} {{$name}} = {{.Value}}
 	{{- end}}
 )
 
+// IsValid reports whether x is a declared value of {{.Name}}
+func (x {{.Name}}) IsValid() bool {
+	{{- if .Members}}
+	switch x {
+	case {{range $i, $v := .Members}}{{if $i}}, {{end}}{{$v.Name}}{{end}}:
+		return true
+	}
+	{{- end}}
+	return false
+}
+
+func (x {{.Name}}) String() string {
+	switch x {
+	{{- range .Members}}
+	case {{.Name}}:
+		return "{{.Name}}"
+	{{- end}}
+	}
+	return "{{.Name}}(" + strconv.FormatUint(uint64(x), 10) + ")"
+}
+
+// Parse{{.Name}} returns the {{.Name}} named s
+func Parse{{.Name}}(s string) ({{.Name}}, error) {
+	switch s {
+	{{- range .Members}}
+	case "{{.Name}}":
+		return {{.Name}}, nil
+	{{- end}}
+	}
+	return 0, fmt.Errorf("%q is not a valid {{.Name}}", s)
+}
+
+func (x {{.Name}}) MarshalText() ([]byte, error) {
+	if !x.IsValid() {
+		return nil, fmt.Errorf("%d is not a valid {{.Name}}", uint32(x))
+	}
+	return []byte(x.String()), nil
+}
+
+func (x *{{.Name}}) UnmarshalText(text []byte) error {
+	v, err := Parse{{.Name}}(string(text))
+	if err != nil {
+		return err
+	}
+	*x = v
+	return nil
+}
+{{end -}}
+`
+
+const _enumSerializationTmpl = `
+{{- range .EnumStats}}
 func (x *{{.Name}}) Marshal() ([]byte, error) {
+	if !x.IsValid() {
+		return nil, fmt.Errorf("marshal failed, %d is not a valid {{.Name}}", uint32(*x))
+	}
 	return MarshalUint32(uint32(*x)), nil
 }
 
 func (x *{{.Name}}) Unmarshal(data []byte) error {
-	v := binary.LittleEndian.Uint32(data)
-	*x = {{.Name}}(v)
+	if len(data) != 4 {
+		return fmt.Errorf("unmarshal failed, {{.Name}} must be 4 bytes")
+	}
+	v := {{.Name}}(binary.LittleEndian.Uint32(data))
+	if !v.IsValid() {
+		return fmt.Errorf("unmarshal failed, %d is not a valid {{.Name}}", uint32(v))
+	}
+	*x = v
 	return nil
 }
 {{end -}}
@@ -78,100 +167,532 @@ type Serializer interface {
 {{ range .StructStats }}
 type {{.Name}} struct {
 	{{- range .Members}}
-	{{.Name}} {{.Type}}
+	{{.Name}} {{.FieldType}}{{with .Tag}} {{.}}{{end}}
 	{{- end}}
 }
-{{ end -}}
+{{ if index $.ErrorMap .Name}}
+func (x *{{.Name}}) Error() string {
+	var b strings.Builder
+	b.WriteString("{{.Name}}")
+	formatValue(&b, reflect.ValueOf(*x))
+	return b.String()
+}
+{{ end}}
+{{- end}}
+{{- if .ErrorMap}}
+// formatValue formats v as %+v does, except that the pointers are formatted as
+// the values they point to, so the optional fields and the nested messages
+// are readable in the errors
+func formatValue(b *strings.Builder, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			b.WriteString("<nil>")
+			return
+		}
+		formatValue(b, v.Elem())
+	case reflect.Struct:
+		b.WriteString("{")
+		for i := 0; i < v.NumField(); i++ {
+			if i != 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(v.Type().Field(i).Name + ":")
+			formatValue(b, v.Field(i))
+		}
+		b.WriteString("}")
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			fmt.Fprint(b, v.Interface())
+			return
+		}
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i != 0 {
+				b.WriteString(" ")
+			}
+			formatValue(b, v.Index(i))
+		}
+		b.WriteString("]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return lessKey(keys[i], keys[j])
+		})
+		b.WriteString("map[")
+		for i, key := range keys {
+			if i != 0 {
+				b.WriteString(" ")
+			}
+			fmt.Fprint(b, key.Interface())
+			b.WriteString(":")
+			formatValue(b, v.MapIndex(key))
+		}
+		b.WriteString("]")
+	default:
+		fmt.Fprint(b, v.Interface())
+	}
+}
+
+// lessKey orders the map keys, they are builtin scalars
+func lessKey(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	}
+	return a.String() < b.String()
+}
+{{end -}}
 `
 
 const _serviceTmpl = `
 {{- range .ServiceStats}}
+{{- $name := .Name}}
 type {{.Name}} interface {
 	{{- range .Members}}
-	{{.Name}}(*{{.Req}} {{- if ne .Resp ""}}, *{{.Resp}} {{- end}}) error
+	{{- if and .ReqStream .RespStream}}
+	{{.Name}}({{if $.Context}}context.Context, {{end}}{{$name}}{{.Name}}Server) error
+	{{- else if .ReqStream}}
+	{{.Name}}({{if $.Context}}context.Context, {{end}}{{$name}}{{.Name}}Server, *{{.Resp}}) error
+	{{- else if .RespStream}}
+	{{.Name}}({{if $.Context}}context.Context, {{end}}*{{.Req}}, {{$name}}{{.Name}}Server) error
+	{{- else}}
+	{{.Name}}({{if $.Context}}context.Context, {{end}}*{{.Req}} {{- if ne .Resp ""}}, *{{.Resp}} {{- end}}) error
+	{{- end}}
 	{{- end}}
 }
 
 type {{.Name}}Handler interface {
 	{{- range .Members}}
-	{{.Name}}Handler(req []byte) (data []byte, err error)
+	{{- if .Stream}}
+	{{.Name}}Handler({{if $.Context}}ctx context.Context, {{end}}stream Stream) error
+	{{- else}}
+	{{.Name}}Handler({{if $.Context}}ctx context.Context, {{end}}req []byte) (data []byte, err error)
+	{{- end}}
 	{{- end}}
 }
 
 type {{.Name}}Complement struct {
 	{{.Name}} {{.Name}}
+
+	serviceName string
+	interceptor Interceptor
 }
-{{- $name := .Name}}
 {{ range .Members }}
-func (c *{{$name}}Complement) {{.Name}}Handler(req []byte) (data []byte, err error) {
+{{- if .Stream}}
+// {{.Name}}Handler passes the interceptors the request, or the stream if the
+// requests are streamed
+func (c *{{$name}}Complement) {{.Name}}Handler({{if $.Context}}ctx context.Context, {{end}}stream Stream) error {
+	{{- if and .ReqStream .RespStream}}
+	return intercept(c.interceptor, {{if $.Context}}ctx, {{end}}c.serviceName+".{{.Name}}", &{{firstLower $name}}{{.Name}}Server{stream}, nil, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		return c.{{$name}}.{{.Name}}({{if $.Context}}ctx, {{end}}args.({{$name}}{{.Name}}Server))
+	})
+	{{- else if .ReqStream}}
+	reply := new({{.Resp}})
+	err := intercept(c.interceptor, {{if $.Context}}ctx, {{end}}c.serviceName+".{{.Name}}", &{{firstLower $name}}{{.Name}}Server{stream}, reply, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		return c.{{$name}}.{{.Name}}({{if $.Context}}ctx, {{end}}args.({{$name}}{{.Name}}Server), reply.(*{{.Resp}}))
+	})
+	if err != nil {
+		return err
+	}
+	return send(stream, reply)
+	{{- else}}
+	args := new({{.Req}})
+	if err := recv(stream, args); err != nil {
+		return err
+	}
+	return intercept(c.interceptor, {{if $.Context}}ctx, {{end}}c.serviceName+".{{.Name}}", args, nil, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		return c.{{$name}}.{{.Name}}({{if $.Context}}ctx, {{end}}args.(*{{.Req}}), &{{firstLower $name}}{{.Name}}Server{stream})
+	})
+	{{- end}}
+}
+
+// {{$name}}{{.Name}}Server is the stream of {{$name}}.{{.Name}} on the server side
+type {{$name}}{{.Name}}Server interface {
+	{{- if .RespStream}}
+	Send(*{{.Resp}}) error
+	{{- end}}
+	{{- if .ReqStream}}
+	// Recv returns io.EOF once the client closes the stream
+	Recv() (*{{.Req}}, error)
+	{{- end}}
+}
+
+type {{firstLower $name}}{{.Name}}Server struct {
+	stream Stream
+}
+{{- if .RespStream}}
+
+func (s *{{firstLower $name}}{{.Name}}Server) Send(v *{{.Resp}}) error {
+	return send(s.stream, v)
+}
+{{- end}}
+{{- if .ReqStream}}
+
+func (s *{{firstLower $name}}{{.Name}}Server) Recv() (*{{.Req}}, error) {
+	v := new({{.Req}})
+	if err := recv(s.stream, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+{{- end}}
+{{else}}
+func (c *{{$name}}Complement) {{.Name}}Handler({{if $.Context}}ctx context.Context, {{end}}req []byte) (data []byte, err error) {
 	args := new({{.Req}})
 	if err := args.Unmarshal(req); err != nil {
 		return nil, err
 	}
 	{{if ne .Resp ""}}
 	reply := new({{.Resp}}){{ end }}
-	if err := c.{{$name}}.{{.Name}}(args{{- if ne .Resp ""}}, reply {{- end}}); err != nil {
+	err = intercept(c.interceptor, {{if $.Context}}ctx, {{end}}c.serviceName+".{{.Name}}", args, {{if ne .Resp ""}}reply{{else}}nil{{end}}, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		return c.{{$name}}.{{.Name}}({{if $.Context}}ctx, {{end}}args.(*{{.Req}}){{- if ne .Resp ""}}, reply.(*{{.Resp}}) {{- end}})
+	})
+	if err != nil {
+		{{- range $i, $t := .Throws}}
+		var e{{$i}} *{{$t}}
+		if errors.As(err, &e{{$i}}) {
+			return marshalStatus({{add $i 1}}, e{{$i}})
+		}
+		{{- end}}
 		return nil, err
 	}
-	{{if ne .Resp ""}}return reply.Marshal(){{else}}return nil, nil{{end}}
+	{{if .Throws}}return marshalStatus(0, reply){{else if ne .Resp ""}}return reply.Marshal(){{else}}return nil, nil{{end}}
 }
 {{end}}
+{{- end}}
 {{- end -}}
 `
 
 const _registerTmpl = `
 {{- range .ServiceStats}}
-func Register{{.Name}}Service(s *drpc.Server, serviceName string, complement {{.Name}}) {
+// Register{{.Name}}Service registers the methods of complement as
+// serviceName.<Method>, the interceptors are called in order around each call
+func Register{{.Name}}Service(s *drpc.Server, {{if .Streams}}streams StreamServer, {{end}}serviceName string, complement {{.Name}}, interceptors ...Interceptor) {
 	c := &{{.Name}}Complement{
-		{{.Name}}: complement,
+		{{.Name}}:     complement,
+		serviceName: serviceName,
+		interceptor: chain(interceptors),
+	}
+	for serviceMethod, handler := range c.handlers() {
+		drpc.RegisterService(s, serviceMethod, handler)
+	}
+	{{- if .Streams}}
+	for serviceMethod, handler := range c.streamHandlers() {
+		streams.RegisterStream(serviceMethod, handler)
 	}
-	{{$name := .Name}}
-	{{- range .Members}}
-	drpc.RegisterService(s, serviceName+".{{.Name}}", c.{{.Name}}Handler)
 	{{- end}}
 }
+
+// handlers returns the handlers of the non-streaming methods, keyed by
+// serviceName.<Method>
+func (c *{{.Name}}Complement) handlers() map[string]func(req []byte) ([]byte, error) {
+	return map[string]func(req []byte) ([]byte, error){
+		{{- range .Members}}
+		{{- if not .Stream}}
+		{{- if $.Context}}
+		c.serviceName + ".{{.Name}}": func(req []byte) ([]byte, error) {
+			ctx, cancel, req, err := newContext(req)
+			if err != nil {
+				return nil, err
+			}
+			defer cancel()
+			return c.{{.Name}}Handler(ctx, req)
+		},
+		{{- else}}
+		c.serviceName + ".{{.Name}}": c.{{.Name}}Handler,
+		{{- end}}
+		{{- end}}
+		{{- end}}
+	}
+}
+{{- if .Streams}}
+
+// streamHandlers returns the handlers of the streaming methods, keyed by
+// serviceName.<Method>
+func (c *{{.Name}}Complement) streamHandlers() map[string]func(stream Stream) error {
+	return map[string]func(stream Stream) error{
+		{{- range .Members}}
+		{{- if .Stream}}
+		{{- if $.Context}}
+		c.serviceName + ".{{.Name}}": func(stream Stream) error {
+			ctx, cancel, err := newStreamContext(stream)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			return c.{{.Name}}Handler(ctx, stream)
+		},
+		{{- else}}
+		c.serviceName + ".{{.Name}}": c.{{.Name}}Handler,
+		{{- end}}
+		{{- end}}
+		{{- end}}
+	}
+}
+{{- end}}
 {{- end}}
 `
 
 const _jsonSerializerTmpl = `
-{{- range .MessageStats}}
+{{- range .StructStats}}
 func (x *{{.Name}}) Marshal() ([]byte, error) {
-	return json.Marshal(x)
+	return x.MarshalJSON()
+}
+
+// MarshalJSON checks the required fields, it is called for the nested
+// messages and the elements of lists and maps too
+func (x *{{.Name}}) MarshalJSON() ([]byte, error) {
+	{{- range .Members}}
+	{{- if not (or .Optional .Scalar)}}
+	if x.{{.Name}} == nil {
+		return nil, fmt.Errorf("marshal failed, {{.Name}} must have value")
+	}
+	{{- end}}
+	{{- end}}
+	type plain {{.Name}}
+	return json.Marshal((*plain)(x))
 }
 
 func (x *{{.Name}}) Unmarshal(data []byte) error {
 	return json.Unmarshal(data, x)
 }
+
+// UnmarshalJSON checks the required fields, it is called for the nested
+// messages and the elements of lists and maps too
+func (x *{{.Name}}) UnmarshalJSON(data []byte) error {
+	{{- if .RequiredScalars}}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	{{- end}}
+	type plain {{.Name}}
+	if err := json.Unmarshal(data, (*plain)(x)); err != nil {
+		return err
+	}
+	{{- range .Members}}
+	{{- if not .Optional}}
+	{{- if .Scalar}}
+	if !hasField(fields, "{{.Name}}") {
+	{{- else}}
+	if x.{{.Name}} == nil {
+	{{- end}}
+		return fmt.Errorf("unmarshal failed, don't find {{.Name}}")
+	}
+	{{- end}}
+	{{- end}}
+	return nil
+}
+{{end}}
+{{- if .RequiredScalars}}
+// hasField reports whether the json object has the field name, it is matched
+// case-insensitively as encoding/json does
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	for key := range fields {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
 {{end -}}
 `
 
 const _defaultSerializerFunc = `
-{{- range .StructStats}}
-func Marshal{{.Name}}(v *{{.Name}}) []byte {
-	data, _ := v.Marshal()
-	return data
+{{- range .MessageRefs}}
+// Marshal{{.Name}} encodes the nested message prefixed by its length
+func Marshal{{.Name}}(v *{{.Type}}) ([]byte, error) {
+	data, err := v.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return MarshalBytes(data), nil
 }
 
-func Unmarshal{{.Name}}(r io.Reader) *{{.Name}} {
-	br := r.(*bytes.Reader)
-	data, _ := io.ReadAll(br)
-	v := new({{.Name}})
-	v.Unmarshal(data)
-	tmp := Marshal{{.Name}}(v)
-	*br = *bytes.NewReader(data[len(tmp):])
+func Unmarshal{{.Name}}(r io.Reader) (*{{.Type}}, error) {
+	opts, err := optionsOf(r).nested()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readBytes(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	v := new({{.Type}})
+	if err := v.UnmarshalWithOptions(data, {{.Qualifier}}DecodeOptions(opts)); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+{{end }}
+{{- range .EnumRefs}}
+func Marshal{{.Name}}(v {{.Type}}) ([]byte, error) {
+	if !v.IsValid() {
+		return nil, fmt.Errorf("%d is not a valid {{typeName .Type}}", uint32(v))
+	}
+	return MarshalUint32(uint32(v)), nil
+}
 
-	return v
+func Unmarshal{{.Name}}(r io.Reader) ({{.Type}}, error) {
+	v, err := UnmarshalUint32(r)
+	return {{.Type}}(v), err
 }
 {{end }}
+// DecodeOptions limits the resources used by UnmarshalWithOptions to decode the
+// untrusted data, the zero value of a field means no limit.
+type DecodeOptions struct {
+	MaxBytes          int // the size of the whole data
+	MaxStringLength   int // the length of a string or bytes
+	MaxCollectionSize int // the number of elements of a list or map
+	MaxDepth          int // the nesting depth of messages
+}
+
+// DefaultDecodeOptions is used by Unmarshal, so the requests decoded by the
+// servers are limited without any configuration.
+var DefaultDecodeOptions = DecodeOptions{
+	MaxBytes:          4 << 20,
+	MaxStringLength:   1 << 20,
+	MaxCollectionSize: 1 << 16,
+	MaxDepth:          32,
+}
+
+// nested returns the options to decode a message nested one level deeper
+func (o DecodeOptions) nested() (DecodeOptions, error) {
+	if o.MaxDepth == 1 {
+		return o, fmt.Errorf("nesting depth exceeds the limit")
+	}
+	if o.MaxDepth > 1 {
+		o.MaxDepth--
+	}
+	return o, nil
+}
+
+// decoder is the reader of a message, it carries the options to the helpers,
+// and lets readBytes take the bytes without copying them
+type decoder struct {
+	data []byte
+	opts DecodeOptions
+}
+
+func newDecoder(data []byte, opts DecodeOptions) (*decoder, error) {
+	if opts.MaxBytes > 0 && len(data) > opts.MaxBytes {
+		return nil, fmt.Errorf("size %d exceeds the limit %d", len(data), opts.MaxBytes)
+	}
+	return &decoder{data: data, opts: opts}, nil
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	if len(d.data) == 0 && len(p) != 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	return n, nil
+}
+
+// optionsOf returns the options carried by r, r read out of a decoder has
+// no limit
+func optionsOf(r io.Reader) DecodeOptions {
+	if d, ok := r.(*decoder); ok {
+		return d.opts
+	}
+	return DecodeOptions{}
+}
+
+// appendField appends the field seq to data, the value is prefixed by its
+// length, so the decoder not knowing seq can skip it
+func appendField(data []byte, seq int, value []byte) []byte {
+	data = append(data, uint8(seq))
+	data = append(data, MarshalInt32(int32(len(value)))...)
+	return append(data, value...)
+}
+
+// readSeq reads the seq of the next field, it returns -1 at the end of data
+func readSeq(r io.Reader) (int, error) {
+	data := make([]byte, 1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			return -1, nil
+		}
+		return 0, err
+	}
+	return int(data[0]), nil
+}
+
+// readFull reads exactly n bytes, it never returns io.EOF since the data
+// ends in the middle of a value
+func readFull(r io.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// readSize reads the length prefix of string, bytes, list and map, the
+// length greater than limit is rejected unless limit is 0
+func readSize(r io.Reader, limit int) (int, error) {
+	size, err := UnmarshalInt32(r)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("invalid length %d", size)
+	}
+	if limit > 0 && int(size) > limit {
+		return 0, fmt.Errorf("length %d exceeds the limit %d", size, limit)
+	}
+	return int(size), nil
+}
+
+// readBytes reads the bytes prefixed by their length. The bytes read from a
+// decoder share its memory, otherwise the memory grows with the data actually
+// read rather than the length, so a forged length can't make it allocate a
+// huge buffer.
+func readBytes(r io.Reader, limit int) ([]byte, error) {
+	size, err := readSize(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := r.(*decoder); ok {
+		if size > len(d.data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data := d.data[:size:size]
+		d.data = d.data[size:]
+		return data, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
 func MarshalUint8(v uint8) []byte {
 	data := []byte{}
 	return append(data, byte(v))
 }
 
-func UnmarshalUint8(r io.Reader) uint8 {
-	data := make([]byte, 1)
-	io.ReadFull(r, data)
-	return uint8(data[0])
+func UnmarshalUint8(r io.Reader) (uint8, error) {
+	data, err := readFull(r, 1)
+	if err != nil {
+		return 0, err
+	}
+	return uint8(data[0]), nil
 }
 
 func MarshalUint16(v uint16) []byte {
@@ -180,10 +701,12 @@ func MarshalUint16(v uint16) []byte {
 	return data
 }
 
-func UnmarshalUint16(r io.Reader) uint16 {
-	data := make([]byte, 2)
-	io.ReadFull(r, data)
-	return binary.LittleEndian.Uint16(data)
+func UnmarshalUint16(r io.Reader) (uint16, error) {
+	data, err := readFull(r, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(data), nil
 }
 
 func MarshalUint32(v uint32) []byte {
@@ -192,10 +715,12 @@ func MarshalUint32(v uint32) []byte {
 	return data
 }
 
-func UnmarshalUint32(r io.Reader) uint32 {
-	data := make([]byte, 4)
-	io.ReadFull(r, data)
-	return binary.LittleEndian.Uint32(data)
+func UnmarshalUint32(r io.Reader) (uint32, error) {
+	data, err := readFull(r, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(data), nil
 }
 
 func MarshalUint64(v uint64) []byte {
@@ -204,10 +729,12 @@ func MarshalUint64(v uint64) []byte {
 	return data
 }
 
-func UnmarshalUint64(r io.Reader) uint64 {
-	data := make([]byte, 8)
-	io.ReadFull(r, data)
-	return binary.LittleEndian.Uint64(data)
+func UnmarshalUint64(r io.Reader) (uint64, error) {
+	data, err := readFull(r, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(data), nil
 }
 
 func MarshalInt8(v int8) []byte {
@@ -215,10 +742,9 @@ func MarshalInt8(v int8) []byte {
 	return append(data, byte(v))
 }
 
-func UnmarshalInt8(r io.Reader) int8 {
-	data := make([]byte, 1)
-	io.ReadFull(r, data)
-	return int8(data[0])
+func UnmarshalInt8(r io.Reader) (int8, error) {
+	v, err := UnmarshalUint8(r)
+	return int8(v), err
 }
 
 func MarshalInt16(v int16) []byte {
@@ -227,10 +753,9 @@ func MarshalInt16(v int16) []byte {
 	return data
 }
 
-func UnmarshalInt16(r io.Reader) int16 {
-	data := make([]byte, 2)
-	io.ReadFull(r, data)
-	return int16(binary.LittleEndian.Uint16(data))
+func UnmarshalInt16(r io.Reader) (int16, error) {
+	v, err := UnmarshalUint16(r)
+	return int16(v), err
 }
 
 func MarshalInt32(v int32) []byte {
@@ -239,10 +764,9 @@ func MarshalInt32(v int32) []byte {
 	return data
 }
 
-func UnmarshalInt32(r io.Reader) int32 {
-	data := make([]byte, 4)
-	io.ReadFull(r, data)
-	return int32(binary.LittleEndian.Uint32(data))
+func UnmarshalInt32(r io.Reader) (int32, error) {
+	v, err := UnmarshalUint32(r)
+	return int32(v), err
 }
 
 func MarshalInt64(v int64) []byte {
@@ -251,10 +775,27 @@ func MarshalInt64(v int64) []byte {
 	return data
 }
 
-func UnmarshalInt64(r io.Reader) int64 {
-	data := make([]byte, 8)
-	io.ReadFull(r, data)
-	return int64(binary.LittleEndian.Uint64(data))
+func UnmarshalInt64(r io.Reader) (int64, error) {
+	v, err := UnmarshalUint64(r)
+	return int64(v), err
+}
+
+func MarshalFloat32(v float32) []byte {
+	return MarshalUint32(math.Float32bits(v))
+}
+
+func UnmarshalFloat32(r io.Reader) (float32, error) {
+	v, err := UnmarshalUint32(r)
+	return math.Float32frombits(v), err
+}
+
+func MarshalFloat64(v float64) []byte {
+	return MarshalUint64(math.Float64bits(v))
+}
+
+func UnmarshalFloat64(r io.Reader) (float64, error) {
+	v, err := UnmarshalUint64(r)
+	return math.Float64frombits(v), err
 }
 
 func MarshalString(s string) []byte {
@@ -264,11 +805,1232 @@ func MarshalString(s string) []byte {
 	return data
 }
 
-func UnmarshalString(r io.Reader) string {
-	size := UnmarshalInt32(r)
+func UnmarshalString(r io.Reader) (string, error) {
+	data, err := readBytes(r, optionsOf(r).MaxStringLength)
+	return string(data), err
+}
+
+func MarshalBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func UnmarshalBool(r io.Reader) (bool, error) {
+	v, err := UnmarshalUint8(r)
+	return v != 0, err
+}
+
+func MarshalBytes(v []byte) []byte {
+	data := []byte{}
+	data = append(data, MarshalInt32(int32(len(v)))...)
+	data = append(data, v...)
+	return data
+}
+
+func UnmarshalBytes(r io.Reader) ([]byte, error) {
+	data, err := readBytes(r, optionsOf(r).MaxStringLength)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, data...), nil
+}
+`
+
+const _clientTmpl = `
+{{- range .ServiceStats}}
+{{- $name := .Name}}
+{{- $client := printf "%sClient" (firstLower .Name)}}
+
+// {{.Name}}Client is the client API of {{.Name}}
+type {{.Name}}Client interface {
+	{{- range .Members}}
+	{{- if .ReqStream}}
+	{{.Name}}({{if $.Context}}context.Context{{end}}) ({{$name}}{{.Name}}Client, error)
+	{{- else if .RespStream}}
+	{{.Name}}({{if $.Context}}context.Context, {{end}}*{{.Req}}) ({{$name}}{{.Name}}Client, error)
+	{{- else}}
+	{{.Name}}({{if $.Context}}context.Context, {{end}}*{{.Req}} {{- if ne .Resp ""}}, *{{.Resp}} {{- end}}) error
+	{{- end}}
+	{{- end}}
+}
+
+type {{$client}} struct {
+	c           caller
+	{{- if .Streams}}
+	streams     StreamDialer
+	{{- end}}
+	serviceName string
+	interceptor Interceptor
+}
+
+// New{{.Name}}Client returns the client calling serviceName.<Method>, the
+// interceptors are called in order around each call
+func New{{.Name}}Client(c *drpc.Client, {{if .Streams}}streams StreamDialer, {{end}}serviceName string, interceptors ...Interceptor) {{.Name}}Client {
+	return &{{$client}}{
+		c:           c,
+		{{- if .Streams}}
+		streams:     streams,
+		{{- end}}
+		serviceName: serviceName,
+		interceptor: chain(interceptors),
+	}
+}
+{{ range .Members }}
+{{- if .Stream}}
+// {{.Name}} runs the interceptors around opening the stream, they are passed
+// {{if .ReqStream}}nil{{else}}the request{{end}} as args
+func (c *{{$client}}) {{.Name}}({{if $.Context}}ctx context.Context{{end}}{{if not .ReqStream}}{{if $.Context}}, {{end}}args *{{.Req}}{{end}}) ({{$name}}{{.Name}}Client, error) {
+	var client {{$name}}{{.Name}}Client
+	err := intercept(c.interceptor, {{if $.Context}}ctx, {{end}}c.serviceName+".{{.Name}}", {{if .ReqStream}}nil{{else}}args{{end}}, nil, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		{{- if not .ReqStream}}
+		req, err := args.(*{{.Req}}).Marshal()
+		if err != nil {
+			return err
+		}
+		{{- end}}
+		{{- if $.Context}}
+		stream, err := openStream(ctx, c.streams, c.serviceName+".{{.Name}}")
+		{{- else}}
+		stream, err := c.streams.Stream(c.serviceName+".{{.Name}}")
+		{{- end}}
+		if err != nil {
+			return err
+		}
+		{{- if not .ReqStream}}
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+		if err := stream.CloseSend(); err != nil {
+			return err
+		}
+		{{- end}}
+		client = &{{firstLower $name}}{{.Name}}Client{stream}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// {{$name}}{{.Name}}Client is the stream of {{$name}}.{{.Name}} on the client side
+type {{$name}}{{.Name}}Client interface {
+	{{- if .ReqStream}}
+	Send(*{{.Req}}) error
+	{{- end}}
+	{{- if .RespStream}}
+	// Recv returns io.EOF once the server finishes the call
+	Recv() (*{{.Resp}}, error)
+	{{- end}}
+	{{- if and .ReqStream .RespStream}}
+	CloseSend() error
+	{{- else if .ReqStream}}
+	// CloseAndRecv closes the stream and receives the response
+	CloseAndRecv(*{{.Resp}}) error
+	{{- end}}
+	// Close cancels the call, the handler blocked in Send or Recv fails
+	Close() error
+}
+
+type {{firstLower $name}}{{.Name}}Client struct {
+	stream Stream
+}
+{{- if .ReqStream}}
+
+func (s *{{firstLower $name}}{{.Name}}Client) Send(v *{{.Req}}) error {
+	return send(s.stream, v)
+}
+{{- end}}
+{{- if .RespStream}}
+
+func (s *{{firstLower $name}}{{.Name}}Client) Recv() (*{{.Resp}}, error) {
+	v := new({{.Resp}})
+	if err := recv(s.stream, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+{{- end}}
+{{- if and .ReqStream .RespStream}}
+
+func (s *{{firstLower $name}}{{.Name}}Client) CloseSend() error {
+	return s.stream.CloseSend()
+}
+{{- else if .ReqStream}}
+
+func (s *{{firstLower $name}}{{.Name}}Client) CloseAndRecv(reply *{{.Resp}}) error {
+	if err := s.stream.CloseSend(); err != nil {
+		return err
+	}
+	return recv(s.stream, reply)
+}
+{{- end}}
+
+func (s *{{firstLower $name}}{{.Name}}Client) Close() error {
+	return s.stream.Close()
+}
+{{else}}
+{{- if eq .Resp ""}}
+// {{.Name}} is a oneway method, it returns once the request is sent
+{{- end}}
+func (c *{{$client}}) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}args *{{.Req}}{{if ne .Resp ""}}, reply *{{.Resp}}{{end}}) error {
+	return intercept(c.interceptor, {{if $.Context}}ctx, {{end}}c.serviceName+".{{.Name}}", args, {{if ne .Resp ""}}reply{{else}}nil{{end}}, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		req, err := args.(*{{.Req}}).Marshal()
+		if err != nil {
+			return err
+		}
+		{{- if $.Context}}
+		req = encodeRequest(ctx, req)
+		{{- end}}
+		{{- if ne .Resp ""}}
+		{{- if $.Context}}
+		data, err := invoke(ctx, func() ([]byte, error) {
+			return c.c.Call(c.serviceName+".{{.Name}}", req)
+		})
+		{{- else}}
+		data, err := c.c.Call(c.serviceName+".{{.Name}}", req)
+		{{- end}}
+		if err != nil {
+			return err
+		}
+		{{- if .Throws}}
+		if len(data) == 0 {
+			return fmt.Errorf("invalid response of %s", c.serviceName+".{{.Name}}")
+		}
+		switch data[0] {
+		case 0:
+			return reply.(*{{.Resp}}).Unmarshal(data[1:])
+		{{- range $i, $t := .Throws}}
+		case {{add $i 1}}:
+			e := new({{$t}})
+			if err := e.Unmarshal(data[1:]); err != nil {
+				return err
+			}
+			return e
+		{{- end}}
+		}
+		return fmt.Errorf("unknown status %d of %s", data[0], c.serviceName+".{{.Name}}")
+		{{- else}}
+		return reply.(*{{.Resp}}).Unmarshal(data)
+		{{- end}}
+		{{- else}}
+		{{- if $.Context}}
+		_, err = invoke(ctx, func() ([]byte, error) {
+			return nil, c.c.Notify(c.serviceName+".{{.Name}}", req)
+		})
+		return err
+		{{- else}}
+		return c.c.Notify(c.serviceName+".{{.Name}}", req)
+		{{- end}}
+		{{- end}}
+	})
+}
+{{end}}
+{{- end}}
+{{- end -}}
+`
+
+const _interceptorTmpl = `
+// Invoker continues the call of a method, reply is nil for the oneway methods
+type Invoker func({{if .Context}}ctx context.Context, {{end}}args, reply interface{}) error
 
-	data := make([]byte, size)
-	io.ReadFull(r, data)
-	return string(data)
+// Interceptor is called around the calls of the methods, method is
+// "serviceName.Method". It continues the call by calling invoker, so it can
+// act before and after the call, or stop the call by returning an error.
+//
+// For the streaming methods, args is the request, or if the requests are
+// streamed, the server stream on the server and nil on the client. The
+// interceptors of the clients only run around opening the stream.
+type Interceptor func({{if .Context}}ctx context.Context, {{end}}method string, args, reply interface{}, invoker Invoker) error
+
+{{- if .Throws}}
+
+// marshalStatus prefixes the response with its status, it is 0 for the reply,
+// and i for the i-th error thrown by the method
+func marshalStatus(status byte, v interface{ Marshal() ([]byte, error) }) ([]byte, error) {
+	data, err := v.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{status}, data...), nil
+}
+{{- end}}
+
+{{- if .Streams}}
+
+// Stream is the message stream of a streaming call, Recv returns io.EOF once
+// the peer closes its side, and Close of the client cancels the call. drpc
+// only carries the unary calls, so the streams are carried by another
+// transport, which declares the same interface.
+type Stream = interface {
+	Send(data []byte) error
+	Recv() ([]byte, error)
+	CloseSend() error
+	Close() error
+}
+
+// StreamServer serves the streaming methods, the handler is called with the
+// stream of each call, and the stream is closed once the handler returns
+type StreamServer interface {
+	RegisterStream(serviceMethod string, handler func(stream Stream) error)
+}
+
+// StreamDialer starts the streaming calls
+type StreamDialer interface {
+	Stream(serviceMethod string) (Stream, error)
+}
+
+// send marshals v and sends it on the stream
+func send(stream Stream, v interface{ Marshal() ([]byte, error) }) error {
+	data, err := v.Marshal()
+	if err != nil {
+		return err
+	}
+	return stream.Send(data)
+}
+
+// recv receives a message from the stream and unmarshals it into v
+func recv(stream Stream, v interface{ Unmarshal([]byte) error }) error {
+	data, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	return v.Unmarshal(data)
+}
+{{- end}}
+
+// chain combines the interceptors into one, the first one is the outermost
+func chain(interceptors []Interceptor) Interceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func({{if .Context}}ctx context.Context, {{end}}method string, args, reply interface{}, invoker Invoker) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], invoker
+			invoker = func({{if .Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+				return interceptor({{if .Context}}ctx, {{end}}method, args, reply, next)
+			}
+		}
+		return invoker({{if .Context}}ctx, {{end}}args, reply)
+	}
+}
+
+func intercept(interceptor Interceptor, {{if .Context}}ctx context.Context, {{end}}method string, args, reply interface{}, invoker Invoker) error {
+	if interceptor == nil {
+		return invoker({{if .Context}}ctx, {{end}}args, reply)
+	}
+	return interceptor({{if .Context}}ctx, {{end}}method, args, reply, invoker)
+}
+`
+
+const _contextTmpl = `
+// Metadata is the key/value pairs sent along with a request, such as auth
+// tokens and trace IDs
+type Metadata map[string]string
+
+type outgoingKey struct{}
+
+type incomingKey struct{}
+
+// NewOutgoingContext returns a copy of ctx carrying md, the clients send md
+// along with the requests made with the returned context
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// FromOutgoingContext returns the metadata set by NewOutgoingContext
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(Metadata)
+	return md, ok
+}
+
+// FromIncomingContext returns the metadata sent by the client, ctx must be
+// the one passed to the handler
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingKey{}).(Metadata)
+	return md, ok
+}
+
+// newContext splits the request received by drpc into the deadline, the
+// metadata and the message, and returns the context passed to the handler. The
+// context is done once the deadline of the client passes, cancel must be called
+// after the handler returns.
+func newContext(req []byte) (context.Context, context.CancelFunc, []byte, error) {
+	deadline, md, data, err := decodeRequest(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx := context.WithValue(context.Background(), incomingKey{}, md)
+	if deadline.IsZero() {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, data, nil
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	return ctx, cancel, data, nil
+}
+
+{{- if .Streams}}
+// newStreamContext receives the deadline and the metadata sent first on the
+// stream, and returns the context passed to the handler
+func newStreamContext(stream Stream) (context.Context, context.CancelFunc, error) {
+	data, err := stream.Recv()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel, _, err := newContext(data)
+	return ctx, cancel, err
+}
+
+// openStream starts the streaming call and sends the deadline and the metadata
+// carried by ctx first, the call is canceled once ctx is done
+func openStream(ctx context.Context, c StreamDialer, serviceMethod string) (Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stream, err := c.Stream(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(encodeRequest(ctx, nil)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return stream, nil
+	}
+	s := &ctxStream{Stream: stream, stop: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-s.stop:
+		}
+	}()
+	return s, nil
+}
+
+// ctxStream stops watching the ctx of the call once the stream is closed or
+// Recv fails
+type ctxStream struct {
+	Stream
+	stop chan struct{}
+	once sync.Once
+}
+
+func (s *ctxStream) Recv() ([]byte, error) {
+	data, err := s.Stream.Recv()
+	if err != nil {
+		s.once.Do(func() { close(s.stop) })
+	}
+	return data, err
+}
+
+func (s *ctxStream) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return s.Stream.Close()
+}
+{{end}}
+// encodeRequest prefixes the request with the deadline and the metadata carried
+// by ctx, the deadline is encoded as unix nanoseconds, 0 means no deadline
+func encodeRequest(ctx context.Context, req []byte) []byte {
+	var data []byte
+	if deadline, ok := ctx.Deadline(); ok {
+		data = binary.LittleEndian.AppendUint64(data, uint64(deadline.UnixNano()))
+	} else {
+		data = binary.LittleEndian.AppendUint64(data, 0)
+	}
+
+	md, _ := FromOutgoingContext(ctx)
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(keys)))
+	for _, k := range keys {
+		data = appendString(data, k)
+		data = appendString(data, md[k])
+	}
+	return append(data, req...)
+}
+
+func appendString(data []byte, s string) []byte {
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(s)))
+	return append(data, s...)
+}
+
+var errMetadata = errors.New("invalid request metadata")
+
+func decodeRequest(data []byte) (time.Time, Metadata, []byte, error) {
+	if len(data) < 12 {
+		return time.Time{}, nil, nil, errMetadata
+	}
+	var deadline time.Time
+	if nsec := int64(binary.LittleEndian.Uint64(data)); nsec != 0 {
+		deadline = time.Unix(0, nsec)
+	}
+	n := binary.LittleEndian.Uint32(data[8:])
+	data = data[12:]
+
+	md := make(Metadata)
+	for i := uint32(0); i < n; i++ {
+		var k, v string
+		var ok bool
+		if k, data, ok = readString(data); !ok {
+			return time.Time{}, nil, nil, errMetadata
+		}
+		if v, data, ok = readString(data); !ok {
+			return time.Time{}, nil, nil, errMetadata
+		}
+		md[k] = v
+	}
+	return deadline, md, data, nil
+}
+
+func readString(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+	size := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < uint64(size) {
+		return "", nil, false
+	}
+	return string(data[:size]), data[size:], true
+}
+
+// invoke runs call in a new goroutine, and returns once call finishes or ctx
+// is done
+func invoke(ctx context.Context, call func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		data, err := call()
+		ch <- result{data: data, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.data, r.err
+	}
+}
+`
+
+const _localTmpl = `
+// caller sends the requests of the clients, it is implemented by *drpc.Client
+// and localCaller
+type caller interface {
+	Call(serviceMethod string, req []byte) ([]byte, error)
+	Notify(serviceMethod string, req []byte) error
+}
+{{range .ServiceStats}}
+// New{{.Name}}LocalClient returns the client calling impl in memory. The
+// requests and responses are marshalled and go through {{.Name}}Complement as
+// if they were sent by drpc, so it tests the whole path without network.
+func New{{.Name}}LocalClient(impl {{.Name}}) {{.Name}}Client {
+	c := &{{.Name}}Complement{
+		{{.Name}}:     impl,
+		serviceName: "{{.Name}}",
+	}
+	l := &localCaller{
+		handlers: c.handlers(),
+		{{- if .Streams}}
+		streams:  c.streamHandlers(),
+		{{- end}}
+	}
+	return &{{firstLower .Name}}Client{
+		c:           l,
+		{{- if .Streams}}
+		streams:     l,
+		{{- end}}
+		serviceName: "{{.Name}}",
+	}
+}
+{{end}}
+// localCaller calls the handlers of the services directly
+type localCaller struct {
+	handlers map[string]func(req []byte) ([]byte, error)
+	{{- if .Streams}}
+	streams  map[string]func(stream Stream) error
+	{{- end}}
+}
+
+func (l *localCaller) Call(serviceMethod string, req []byte) ([]byte, error) {
+	handler, ok := l.handlers[serviceMethod]
+	if !ok {
+		return nil, fmt.Errorf("service %s is not found", serviceMethod)
+	}
+	return handler(req)
+}
+
+// Notify runs the handler before it returns, and drops the result as drpc does
+func (l *localCaller) Notify(serviceMethod string, req []byte) error {
+	handler, ok := l.handlers[serviceMethod]
+	if !ok {
+		return fmt.Errorf("service %s is not found", serviceMethod)
+	}
+	handler(req)
+	return nil
+}
+{{- if .Streams}}
+
+// Stream runs the handler in its own goroutine, the stream is closed once the
+// handler returns
+func (l *localCaller) Stream(serviceMethod string) (Stream, error) {
+	handler, ok := l.streams[serviceMethod]
+	if !ok {
+		return nil, fmt.Errorf("service %s is not found", serviceMethod)
+	}
+
+	call := &localCall{
+		requests:  make(chan []byte, 16),
+		responses: make(chan []byte, 16),
+		closed:    make(chan struct{}),
+		canceled:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		call.err = handler(&localServerStream{call})
+		close(call.responses)
+		close(call.done)
+	}()
+	return &localClientStream{localCall: call}, nil
+}
+
+var (
+	errLocalClosed   = errors.New("send on closed stream")
+	errLocalCanceled = errors.New("stream canceled by the client")
+)
+
+type localCall struct {
+	requests  chan []byte
+	responses chan []byte
+	closed    chan struct{} // closed by CloseSend of the client
+	canceled  chan struct{} // closed by Close of the client
+	done      chan struct{} // closed once the handler returns
+	err       error         // the error returned by the handler
+}
+
+type localClientStream struct {
+	*localCall
+	closeOnce  sync.Once
+	cancelOnce sync.Once
+}
+
+func (s *localClientStream) Send(data []byte) error {
+	select {
+	case <-s.canceled:
+		return errLocalCanceled
+	default:
+	}
+	select {
+	case <-s.closed:
+		return errLocalClosed
+	default:
+	}
+	select {
+	case s.requests <- data:
+		return nil
+	case <-s.done:
+		return io.EOF
+	case <-s.canceled:
+		return errLocalCanceled
+	}
+}
+
+func (s *localClientStream) Recv() ([]byte, error) {
+	select {
+	case <-s.canceled:
+		return nil, errLocalCanceled
+	default:
+	}
+	select {
+	case data, ok := <-s.responses:
+		if !ok {
+			if s.err != nil {
+				return nil, s.err
+			}
+			return nil, io.EOF
+		}
+		return data, nil
+	case <-s.canceled:
+		return nil, errLocalCanceled
+	}
+}
+
+func (s *localClientStream) CloseSend() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// Close cancels the call, the handler blocked in Send or Recv is released
+func (s *localClientStream) Close() error {
+	s.cancelOnce.Do(func() {
+		close(s.canceled)
+	})
+	return nil
+}
+
+type localServerStream struct {
+	*localCall
+}
+
+func (s *localServerStream) Send(data []byte) error {
+	select {
+	case s.responses <- data:
+		return nil
+	case <-s.canceled:
+		return errLocalCanceled
+	}
+}
+
+func (s *localServerStream) Recv() ([]byte, error) {
+	select {
+	case data := <-s.requests:
+		return data, nil
+	case <-s.closed:
+		// the requests sent before CloseSend are received first
+		select {
+		case data := <-s.requests:
+			return data, nil
+		default:
+			return nil, io.EOF
+		}
+	case <-s.canceled:
+		return nil, errLocalCanceled
+	}
+}
+
+// CloseSend does nothing, the stream is closed once the handler returns
+func (s *localServerStream) CloseSend() error {
+	return nil
+}
+
+// Close does nothing, the stream is closed once the handler returns
+func (s *localServerStream) Close() error {
+	return nil
+}
+{{- end}}
+`
+
+const _mockTmpl = `package {{.Name}}
+
+import (
+{{- if .Context}}
+	"context"
+{{- end}}
+	"sync"
+{{- if .MockImports}}
+{{range .MockImports}}
+	{{.}}
+{{- end}}
+{{- end}}
+)
+
+// MockCall is a call recorded by the mocks
+type MockCall struct {
+	Method string
+	Args   interface{} // the request, it is nil for the client streaming methods
+}
+{{range .ServiceStats}}
+{{- $name := .Name}}
+{{- if not .Streams}}
+var _ {{.Name}} = (*Mock{{.Name}})(nil)
+{{- end}}
+var _ {{.Name}}Client = (*Mock{{.Name}})(nil)
+
+// Mock{{.Name}} is a mock of {{if not .Streams}}{{.Name}} and {{end}}{{.Name}}Client{{if .Streams}}, {{.Name}} is mocked by Mock{{.Name}}Server{{end}}.
+// Every call is recorded, and the method calls <Method>Func if it is set,
+// otherwise it returns nil.
+type Mock{{.Name}} struct {
+	{{- range .Members}}
+	{{- if .ReqStream}}
+	{{.Name}}Func func({{if $.Context}}context.Context{{end}}) ({{$name}}{{.Name}}Client, error)
+	{{- else if .RespStream}}
+	{{.Name}}Func func({{if $.Context}}context.Context, {{end}}*{{.Req}}) ({{$name}}{{.Name}}Client, error)
+	{{- else}}
+	{{.Name}}Func func({{if $.Context}}context.Context, {{end}}*{{.Req}} {{- if ne .Resp ""}}, *{{.Resp}} {{- end}}) error
+	{{- end}}
+	{{- end}}
+
+	mu    sync.Mutex
+	calls []MockCall
+}
+
+// Calls returns the recorded calls in order
+func (m *Mock{{.Name}}) Calls() []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockCall(nil), m.calls...)
+}
+
+func (m *Mock{{.Name}}) record(method string, args interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, MockCall{Method: method, Args: args})
+}
+{{range .Members}}
+{{- if .ReqStream}}
+func (m *Mock{{$name}}) {{.Name}}({{if $.Context}}ctx context.Context{{end}}) ({{$name}}{{.Name}}Client, error) {
+	m.record("{{.Name}}", nil)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx{{end}})
+	}
+	return nil, nil
+}
+
+// Stub{{.Name}} makes {{.Name}} return stream and err
+func (m *Mock{{$name}}) Stub{{.Name}}(stream {{$name}}{{.Name}}Client, err error) {
+	m.{{.Name}}Func = func({{if $.Context}}context.Context{{end}}) ({{$name}}{{.Name}}Client, error) {
+		return stream, err
+	}
+}
+{{- else if .RespStream}}
+func (m *Mock{{$name}}) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}args *{{.Req}}) ({{$name}}{{.Name}}Client, error) {
+	m.record("{{.Name}}", args)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx, {{end}}args)
+	}
+	return nil, nil
+}
+
+// Stub{{.Name}} makes {{.Name}} return stream and err
+func (m *Mock{{$name}}) Stub{{.Name}}(stream {{$name}}{{.Name}}Client, err error) {
+	m.{{.Name}}Func = func({{if $.Context}}context.Context, {{end}}*{{.Req}}) ({{$name}}{{.Name}}Client, error) {
+		return stream, err
+	}
+}
+{{- else}}
+func (m *Mock{{$name}}) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}args *{{.Req}}{{if ne .Resp ""}}, reply *{{.Resp}}{{end}}) error {
+	m.record("{{.Name}}", args)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx, {{end}}args{{if ne .Resp ""}}, reply{{end}})
+	}
+	return nil
+}
+{{- if ne .Resp ""}}
+
+// Stub{{.Name}} makes {{.Name}} copy resp into the reply if resp is not nil,
+// and return err
+func (m *Mock{{$name}}) Stub{{.Name}}(resp *{{.Resp}}, err error) {
+	m.{{.Name}}Func = func({{if $.Context}}_ context.Context, {{end}}_ *{{.Req}}, reply *{{.Resp}}) error {
+		if resp != nil {
+			*reply = *resp
+		}
+		return err
+	}
+}
+{{- else}}
+
+// Stub{{.Name}} makes {{.Name}} return err
+func (m *Mock{{$name}}) Stub{{.Name}}(err error) {
+	m.{{.Name}}Func = func({{if $.Context}}context.Context, {{end}}*{{.Req}}) error {
+		return err
+	}
+}
+{{- end}}
+{{- end}}
+{{end}}
+{{- if .Streams}}
+var _ {{.Name}} = (*Mock{{.Name}}Server)(nil)
+
+// Mock{{.Name}}Server is a mock of {{.Name}}, the mock of the service with
+// streaming methods is separated from its client. Every call is recorded, and
+// the method calls <Method>Func if it is set, otherwise it returns nil.
+type Mock{{.Name}}Server struct {
+	{{- range .Members}}
+	{{- if and .ReqStream .RespStream}}
+	{{.Name}}Func func({{if $.Context}}context.Context, {{end}}{{$name}}{{.Name}}Server) error
+	{{- else if .ReqStream}}
+	{{.Name}}Func func({{if $.Context}}context.Context, {{end}}{{$name}}{{.Name}}Server, *{{.Resp}}) error
+	{{- else if .RespStream}}
+	{{.Name}}Func func({{if $.Context}}context.Context, {{end}}*{{.Req}}, {{$name}}{{.Name}}Server) error
+	{{- else}}
+	{{.Name}}Func func({{if $.Context}}context.Context, {{end}}*{{.Req}} {{- if ne .Resp ""}}, *{{.Resp}} {{- end}}) error
+	{{- end}}
+	{{- end}}
+
+	mu    sync.Mutex
+	calls []MockCall
+}
+
+// Calls returns the recorded calls in order
+func (m *Mock{{.Name}}Server) Calls() []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockCall(nil), m.calls...)
+}
+
+func (m *Mock{{.Name}}Server) record(method string, args interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, MockCall{Method: method, Args: args})
+}
+{{range .Members}}
+{{- if and .ReqStream .RespStream}}
+func (m *Mock{{$name}}Server) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}stream {{$name}}{{.Name}}Server) error {
+	m.record("{{.Name}}", nil)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx, {{end}}stream)
+	}
+	return nil
+}
+
+// Stub{{.Name}} makes {{.Name}} return err
+func (m *Mock{{$name}}Server) Stub{{.Name}}(err error) {
+	m.{{.Name}}Func = func({{if $.Context}}context.Context, {{end}}{{$name}}{{.Name}}Server) error {
+		return err
+	}
+}
+{{- else if .ReqStream}}
+func (m *Mock{{$name}}Server) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}stream {{$name}}{{.Name}}Server, reply *{{.Resp}}) error {
+	m.record("{{.Name}}", nil)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx, {{end}}stream, reply)
+	}
+	return nil
+}
+
+// Stub{{.Name}} makes {{.Name}} copy resp into the reply if resp is not nil,
+// and return err
+func (m *Mock{{$name}}Server) Stub{{.Name}}(resp *{{.Resp}}, err error) {
+	m.{{.Name}}Func = func({{if $.Context}}_ context.Context, {{end}}_ {{$name}}{{.Name}}Server, reply *{{.Resp}}) error {
+		if resp != nil {
+			*reply = *resp
+		}
+		return err
+	}
+}
+{{- else if .RespStream}}
+func (m *Mock{{$name}}Server) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}args *{{.Req}}, stream {{$name}}{{.Name}}Server) error {
+	m.record("{{.Name}}", args)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx, {{end}}args, stream)
+	}
+	return nil
+}
+
+// Stub{{.Name}} makes {{.Name}} return err
+func (m *Mock{{$name}}Server) Stub{{.Name}}(err error) {
+	m.{{.Name}}Func = func({{if $.Context}}context.Context, {{end}}*{{.Req}}, {{$name}}{{.Name}}Server) error {
+		return err
+	}
+}
+{{- else}}
+func (m *Mock{{$name}}Server) {{.Name}}({{if $.Context}}ctx context.Context, {{end}}args *{{.Req}}{{if ne .Resp ""}}, reply *{{.Resp}}{{end}}) error {
+	m.record("{{.Name}}", args)
+	if m.{{.Name}}Func != nil {
+		return m.{{.Name}}Func({{if $.Context}}ctx, {{end}}args{{if ne .Resp ""}}, reply{{end}})
+	}
+	return nil
+}
+{{- if ne .Resp ""}}
+
+// Stub{{.Name}} makes {{.Name}} copy resp into the reply if resp is not nil,
+// and return err
+func (m *Mock{{$name}}Server) Stub{{.Name}}(resp *{{.Resp}}, err error) {
+	m.{{.Name}}Func = func({{if $.Context}}_ context.Context, {{end}}_ *{{.Req}}, reply *{{.Resp}}) error {
+		if resp != nil {
+			*reply = *resp
+		}
+		return err
+	}
+}
+{{- else}}
+
+// Stub{{.Name}} makes {{.Name}} return err
+func (m *Mock{{$name}}Server) Stub{{.Name}}(err error) {
+	m.{{.Name}}Func = func({{if $.Context}}context.Context, {{end}}*{{.Req}}) error {
+		return err
+	}
+}
+{{- end}}
+{{- end}}
+{{end}}
+{{- end}}
+{{- end -}}
+`
+
+const _gatewayTmpl = `package {{.Name}}
+
+import (
+{{- range .GatewayStdImports}}
+	"{{.}}"
+{{- end}}
+{{- if .GatewayImports}}
+{{range .GatewayImports}}
+	{{.}}
+{{- end}}
+{{- end}}
+)
+{{range .GatewayStats}}
+{{- $name := .Name}}
+{{- $gateway := printf "%sGateway" (firstLower .Name)}}
+// New{{.Name}}Gateway returns the http.Handler serving impl over HTTP/JSON.
+// A method is served at POST /{{.Name}}/<Method> unless it declares http_method
+// or http_path, the request is taken from the JSON body, or from the query
+// parameters for GET and DELETE. The streaming methods are not served.
+func New{{.Name}}Gateway(impl {{.Name}}, interceptors ...Interceptor) http.Handler {
+	g := &{{$gateway}}{
+		impl:        impl,
+		interceptor: chain(interceptors),
+	}
+	return gateway{
+		{{- range .Routes}}
+		"{{.Path}}": {
+			{{- range .Methods}}
+			"{{.HTTPMethod}}": g.{{.Name}},
+			{{- end}}
+		},
+		{{- end}}
+	}
+}
+
+type {{$gateway}} struct {
+	impl        {{.Name}}
+	interceptor Interceptor
+}
+{{range .Methods}}
+func (g *{{$gateway}}) {{.Name}}(w http.ResponseWriter, r *http.Request) {
+	args := new({{.Req}})
+	{{- if .Query}}
+	{{- if .Fields}}
+	query := r.URL.Query()
+	{{- end}}
+	{{- range .Fields}}
+	if v, ok := query["{{.Key}}"]; ok {
+		{{- if .Parse}}
+		n, err := {{.Parse}}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, gatewayError{Error: "invalid query parameter {{.Key}}: " + err.Error()})
+			return
+		}
+		{{- if .Pointer}}
+		val := {{.Type}}(n)
+		args.{{.Name}} = &val
+		{{- else}}
+		args.{{.Name}} = {{.Type}}(n)
+		{{- end}}
+		{{- else if .Pointer}}
+		args.{{.Name}} = &v[0]
+		{{- else}}
+		args.{{.Name}} = v[0]
+		{{- end}}
+	}{{if .Required}} else {
+		writeJSON(w, http.StatusBadRequest, gatewayError{Error: "missing query parameter {{.Key}}"})
+		return
+	}{{end}}
+	{{- end}}
+	{{- range .Unset}}
+	if args.{{.}} == nil {
+		writeJSON(w, http.StatusBadRequest, gatewayError{Error: "missing required field {{.}}"})
+		return
+	}
+	{{- end}}
+	{{- else}}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if body != nil {
+		if err := json.Unmarshal(body, args); err != nil {
+			writeJSON(w, http.StatusBadRequest, gatewayError{Error: "invalid request body: " + err.Error()})
+			return
+		}
+	}
+	if err := {{.Validate}}(body, ""); err != nil {
+		writeJSON(w, http.StatusBadRequest, gatewayError{Error: "invalid request body: " + err.Error()})
+		return
+	}
+	{{- end}}
+	{{- if ne .Resp ""}}
+	reply := new({{.Resp}})
+	{{- end}}
+
+	err := intercept(g.interceptor, {{if $.Context}}r.Context(), {{end}}"{{$name}}.{{.Name}}", args, {{if ne .Resp ""}}reply{{else}}nil{{end}}, func({{if $.Context}}ctx context.Context, {{end}}args, reply interface{}) error {
+		return g.impl.{{.Name}}({{if $.Context}}ctx, {{end}}args.(*{{.Req}}){{- if ne .Resp ""}}, reply.(*{{.Resp}}) {{- end}})
+	})
+	if err != nil {
+		{{- range $i, $t := .Throws}}
+		var e{{$i}} *{{$t}}
+		if errors.As(err, &e{{$i}}) {
+			writeJSON(w, http.StatusBadRequest, gatewayError{Error: "{{typeName $t}}", Detail: e{{$i}}})
+			return
+		}
+		{{- end}}
+		writeJSON(w, http.StatusInternalServerError, gatewayError{Error: err.Error()})
+		return
+	}
+	{{- if ne .Resp ""}}
+	writeJSON(w, http.StatusOK, reply)
+	{{- else}}
+	w.WriteHeader(http.StatusNoContent)
+	{{- end}}
+}
+{{end}}
+{{- end}}
+{{- if .GatewayValidators}}
+// MaxGatewayBodySize limits the size of the JSON request bodies read by the
+// gateways, the larger requests are rejected with 413
+var MaxGatewayBodySize int64 = 4 << 20
+
+// readBody reads the JSON value of the request body, it is nil if the body is
+// empty. The error response is written if ok is false.
+func readBody(w http.ResponseWriter, r *http.Request) (body json.RawMessage, ok bool) {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxGatewayBodySize)).Decode(&body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, gatewayError{Error: "request body too large"})
+		return nil, false
+	}
+	if err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, gatewayError{Error: "invalid request body: " + err.Error()})
+		return nil, false
+	}
+	return body, true
+}
+{{range .GatewayValidators}}
+// {{.Func}} checks the required fields of {{.Name}} are present in the JSON
+// object data, path is the position of the object in the request
+func {{.Func}}(data json.RawMessage, path string) error {
+	var fields map[string]json.RawMessage
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+	}
+	{{- range .Fields}}
+	{{- if .Required}}
+	if {{if or .Nullable .Check}}v{{else}}_{{end}}, ok := jsonField(fields, "{{.Name}}"); !ok{{if .Nullable}} || string(v) == "null"{{end}} {
+		return fmt.Errorf("missing required field %s", fieldPath(path, "{{.Name}}"))
+	}{{if .Check}} else if err := {{.Check}}(v, fieldPath(path, "{{.Name}}")); err != nil {
+		return err
+	}{{end}}
+	{{- else if .Check}}
+	if v, ok := jsonField(fields, "{{.Name}}"); ok && string(v) != "null" {
+		if err := {{.Check}}(v, fieldPath(path, "{{.Name}}")); err != nil {
+			return err
+		}
+	}
+	{{- end}}
+	{{- end}}
+	return nil
+}
+{{end}}
+{{- if .GatewayLists}}
+// listOf returns the validator of the JSON array checking every element by ele
+func listOf(ele func(json.RawMessage, string) error) func(json.RawMessage, string) error {
+	return func(data json.RawMessage, path string) error {
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		for i, v := range list {
+			if err := ele(v, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+{{end}}
+{{- if .GatewayMaps}}
+// mapOf returns the validator of the JSON object checking every value by val
+func mapOf(val func(json.RawMessage, string) error) func(json.RawMessage, string) error {
+	return func(data json.RawMessage, path string) error {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := val(m[k], fmt.Sprintf("%s[%q]", path, k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+{{end}}
+// jsonField returns the field name of the JSON object, it is matched
+// case-insensitively as encoding/json does
+func jsonField(fields map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	if v, ok := fields[name]; ok {
+		return v, true
+	}
+	for key, v := range fields {
+		if strings.EqualFold(key, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func fieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+{{end}}
+// gateway routes the requests by the path and then by the HTTP method
+type gateway map[string]map[string]http.HandlerFunc
+
+func (g gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methods, ok := g[r.URL.Path]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, gatewayError{Error: "not found"})
+		return
+	}
+	handler, ok := methods[r.Method]
+	if !ok {
+		allow := make([]string, 0, len(methods))
+		for method := range methods {
+			allow = append(allow, method)
+		}
+		sort.Strings(allow)
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, gatewayError{Error: "method not allowed"})
+		return
+	}
+	handler(w, r)
+}
+
+// gatewayError is the body of the failed responses, Error is the name of the
+// message for the errors thrown by the methods, and Detail is the message
+type gatewayError struct {
+	Error  string      ` + "`" + `json:"error"` + "`" + `
+	Detail interface{} ` + "`" + `json:"detail,omitempty"` + "`" + `
+}
+
+// writeJSON writes v as the body of the response, the messages missing the
+// required fields can't be encoded, the response is 500 then
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(gatewayError{Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
 }
 `
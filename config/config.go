@@ -1,7 +1,12 @@
 package config
 
 type CodegenConfig struct {
-	Filename   string
-	OutputDir  string
-	EncodeType string
+	Filename     string
+	IncludePaths []string // the dirs to search the imported files
+	ModulePath   string   // the go import path of OutputDir
+	OutputDir    string
+	EncodeType   string
+	Context      bool // pass context.Context to the service methods
+	Mock         bool // generate the mocks of the services
+	Gateway      bool // generate the HTTP/JSON gateways of the services
 }
@@ -3,41 +3,98 @@ package main
 import (
 	"dgen/codegen"
 	"dgen/config"
+	"dgen/parser"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 )
 
+// stringsFlag is a flag which can be set multiple times
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 var filename string
+var includePaths stringsFlag
+var modulePath string
 var language string
 var outputDir string
 var encodeType string
+var diagnosticsFormat string
+var withContext bool
+var withMock bool
+var withGateway bool
 
 func init() {
 	flag.StringVar(&filename, "f", "", "filename")
 	flag.StringVar(&language, "l", "", "the language to generate")
+	flag.Var(&includePaths, "I", "the dir to search the imported files, can be set multiple times")
+	flag.StringVar(&modulePath, "m", "", "the go import path of the output dir")
 	flag.StringVar(&outputDir, "o", ".", "the dir of output file")
 	flag.StringVar(&encodeType, "e", "", "the type of encoding")
+	flag.BoolVar(&withContext, "ctx", false, "pass context.Context to the generated service methods")
+	flag.BoolVar(&withMock, "mock", false, "generate the mocks of the services into <name>.mock.go")
+	flag.BoolVar(&withGateway, "gateway", false, "generate the HTTP/JSON gateways of the services into <name>.gateway.go")
+	flag.StringVar(&diagnosticsFormat, "diagnostics-format", "text", "the format of reported errors, text or json")
 }
 
 func main() {
 	flag.Parse()
 	if filename == "" {
-		log.Println("filename cannot be empty")
-		return
+		log.Fatalln("filename cannot be empty")
 	}
 	if language == "" {
-		log.Println("language cannot be empty")
-		return
+		log.Fatalln("language cannot be empty")
+	}
+	if diagnosticsFormat != "text" && diagnosticsFormat != "json" {
+		log.Fatalln("diagnostics-format must be text or json")
+	}
+
+	gen, ok := codegen.CodegenMap[language]
+	if !ok {
+		log.Fatalf("unsupported language %s\n", language)
 	}
 
 	config := &config.CodegenConfig{
-		Filename:   filename,
-		OutputDir:  outputDir,
-		EncodeType: encodeType,
+		Filename:     filename,
+		IncludePaths: includePaths,
+		ModulePath:   modulePath,
+		OutputDir:    outputDir,
+		EncodeType:   encodeType,
+		Context:      withContext,
+		Mock:         withMock,
+		Gateway:      withGateway,
+	}
+
+	if err := gen(config); err != nil {
+		report(err)
+		os.Exit(1)
+	}
+}
+
+// report prints the error in the format chosen by -diagnostics-format
+func report(err error) {
+	var diags parser.Diagnostics
+	if !errors.As(err, &diags) {
+		diags = parser.Diagnostics{{File: filename, Message: err.Error()}}
 	}
 
-	err := codegen.CodegenMap[language](config)
-	if err != nil {
-		log.Println("failed to generate code, error: ", err)
+	if diagnosticsFormat == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(diags); err != nil {
+			log.Println("failed to encode diagnostics, error: ", err)
+		}
+		return
 	}
+	fmt.Fprintln(os.Stderr, diags)
 }
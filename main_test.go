@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dgen/parser"
+)
+
+// the test binary runs main instead of the tests if DGEN_MAIN is set, so the
+// exit code and the output of the command can be checked
+func TestMain(m *testing.M) {
+	if os.Getenv("DGEN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// dgen runs the command with args, and returns its stdout, stderr and exit code
+func dgen(t *testing.T, args ...string) (string, string, int) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "DGEN_MAIN=1")
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.dgen")
+	if err := os.WriteFile(broken, []byte("message A {\n\tseq=1 string name\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "nope.dgen")
+
+	_, stderr, code := dgen(t, "-f", missing, "-l", "go", "-o", dir)
+	if code != 1 || !strings.HasPrefix(stderr, missing+": open ") {
+		t.Errorf("unexpected exit code %d and output %q", code, stderr)
+	}
+
+	_, stderr, code = dgen(t, "-f", broken, "-l", "go", "-o", dir)
+	if want := broken + ":3:1: expected ';', found '}'\n}\n^\n"; code != 1 || stderr != want {
+		t.Errorf("unexpected exit code %d and output %q, want %q", code, stderr, want)
+	}
+
+	for _, test := range []struct {
+		file string
+		want parser.Diagnostic
+	}{
+		{missing, parser.Diagnostic{File: missing}},
+		{broken, parser.Diagnostic{File: broken, Line: 3, Column: 1, Expected: "';'", Found: "'}'", Source: "}"}},
+	} {
+		stdout, _, code := dgen(t, "-f", test.file, "-l", "go", "-o", dir, "-diagnostics-format=json")
+		var diags []parser.Diagnostic
+		if err := json.Unmarshal([]byte(stdout), &diags); err != nil {
+			t.Fatalf("invalid json output %q: %s", stdout, err)
+		}
+		if code != 1 || len(diags) != 1 {
+			t.Fatalf("unexpected exit code %d and output %q", code, stdout)
+		}
+		d := diags[0]
+		d.Message = ""
+		if d != test.want {
+			t.Errorf("unexpected diagnostic %+v, want %+v", d, test.want)
+		}
+	}
+	if stdout, _, _ := dgen(t, "-f", missing, "-l", "go", "-o", dir, "-diagnostics-format=json"); strings.Contains(stdout, `"line"`) {
+		t.Errorf("line of the diagnostic without position is not omitted: %s", stdout)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("unexpected files written: %v", entries)
+	}
+}
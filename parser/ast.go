@@ -1,13 +1,45 @@
 package parser
 
+// Position is a 1-based location in the IDL file.
+type Position struct {
+	Line   int
+	Column int
+}
+
+type ImportStat struct {
+	Path string
+	File *Parser // the imported file, set by Load
+
+	Pos Position
+}
+
+type OptionStat struct {
+	Name  string
+	Value string
+
+	Pos Position
+}
+
 type EnumStat struct {
 	Name    string
-	Members []string
+	Members []*EnumMember
+
+	Pos Position
+}
+
+type EnumMember struct {
+	Name  string
+	Value int64 // the explicit value, or the value of previous member plus 1
+
+	Pos      Position
+	ValuePos Position
 }
 
 type MessageStat struct {
 	Name    string
 	Members []*MessageMember
+
+	Pos Position
 }
 
 type MessageMember struct {
@@ -15,17 +47,57 @@ type MessageMember struct {
 	Optional bool
 	Type     interface{}
 	Name     string
+
+	Pos     Position // position of the name
+	SeqPos  Position
+	TypePos Position
 }
 
 type ServiceStat struct {
 	Name    string
 	Members []ServiceMember
+
+	Pos Position
 }
 
 type ServiceMember struct {
-	Name string
-	Req  string
-	Resp string
+	Name       string
+	Req        string
+	Resp       string
+	ReqStream  bool     // the client sends a stream of Req
+	RespStream bool     // the server sends a stream of Resp
+	Throws     []string // the error messages of the method
+	Options    []*OptionStat
+
+	Pos       Position
+	ReqPos    Position
+	RespPos   Position
+	ThrowsPos []Position
+}
+
+// Option returns the value of the option declared for the method
+func (m ServiceMember) Option(name string) (string, bool) {
+	for _, os := range m.Options {
+		if os.Name == name {
+			return os.Value, true
+		}
+	}
+	return "", false
+}
+
+// HTTPRoute returns the HTTP method and path which the gateway serves the
+// method at, it is POST /<Service>/<Method> unless the method declares
+// http_method or http_path.
+func (ss *ServiceStat) HTTPRoute(m ServiceMember) (string, string) {
+	method, ok := m.Option("http_method")
+	if !ok {
+		method = "POST"
+	}
+	path, ok := m.Option("http_path")
+	if !ok {
+		path = "/" + ss.Name + "/" + m.Name
+	}
+	return method, path
 }
 
 type MapType struct {
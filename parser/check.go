@@ -0,0 +1,407 @@
+package parser
+
+import (
+	"dgen/utils"
+	"fmt"
+	gotoken "go/token"
+	"math"
+	"sort"
+	"strings"
+)
+
+type symbolKind int
+
+const (
+	symbolEnum symbolKind = iota
+	symbolMessage
+	symbolService
+)
+
+type symbol struct {
+	kind symbolKind
+	file *Parser
+	pos  Position
+}
+
+// where describes the declaration position of the symbol, the file name is
+// omitted if the symbol is declared in the given file.
+func (s symbol) where(p *Parser) string {
+	if s.file == p {
+		return fmt.Sprintf("%d:%d", s.pos.Line, s.pos.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", s.file.Filename, s.pos.Line, s.pos.Column)
+}
+
+type checker struct {
+	p       *Parser
+	symbols map[string]symbol
+	// the enum members of the file, they are constants of the same scope in
+	// the generated code
+	enumMembers map[string]*EnumStat
+	// the thrown messages which have been checked
+	errors map[string]bool
+	diags  Diagnostics
+}
+
+// Check validates the semantic of a parsed file: every type reference must be
+// resolved, names and seqs must be unique, and the request and response of a
+// service method must be messages. The enums and messages of the directly
+// imported files are visible to the file. All the problems are returned
+// together as Diagnostics.
+func Check(p *Parser) error {
+	c := &checker{
+		p:           p,
+		symbols:     make(map[string]symbol),
+		enumMembers: make(map[string]*EnumStat),
+		errors:      make(map[string]bool),
+	}
+
+	c.checkOptions()
+	c.collect()
+	for _, es := range p.EnumStats {
+		c.checkEnum(es)
+	}
+	for _, ms := range p.MessageStats {
+		c.checkMessage(ms)
+	}
+	for _, ss := range p.ServiceStats {
+		c.checkService(ss)
+	}
+
+	if len(c.diags) == 0 {
+		return nil
+	}
+	sort.SliceStable(c.diags, func(i, j int) bool {
+		if c.diags[i].Line != c.diags[j].Line {
+			return c.diags[i].Line < c.diags[j].Line
+		}
+		return c.diags[i].Column < c.diags[j].Column
+	})
+	return c.diags
+}
+
+func (c *checker) errorf(pos Position, format string, args ...interface{}) {
+	c.diags = append(c.diags, c.p.errorAt(pos, format, args...))
+}
+
+// collect the declared enums, messages and services. The generated code
+// capitalises every name, so names that only differ in the first letter
+// collide.
+func (c *checker) collect() {
+	for _, is := range c.p.ImportStats {
+		dep := is.File
+		if dep == nil {
+			continue
+		}
+		declare := func(name string, kind symbolKind, pos Position) {
+			key := utils.FirstUpper(name)
+			if prev, ok := c.symbols[key]; ok && prev.file != dep {
+				c.errorf(is.Pos, "%s imported from %s is also declared at %s", name, dep.Filename, prev.where(c.p))
+				return
+			}
+			c.symbols[key] = symbol{kind: kind, file: dep, pos: pos}
+		}
+		for _, es := range dep.EnumStats {
+			declare(es.Name, symbolEnum, es.Pos)
+		}
+		for _, ms := range dep.MessageStats {
+			declare(ms.Name, symbolMessage, ms.Pos)
+		}
+	}
+
+	declare := func(name string, kind symbolKind, pos Position) {
+		key := utils.FirstUpper(name)
+		c.checkName(name, pos)
+		if kind != symbolService && IsBuiltin(utils.FirstLower(key)) {
+			c.errorf(pos, "%s conflicts with the builtin type %s", name, utils.FirstLower(key))
+			return
+		}
+		// the name is still declared, so the references to it are resolved
+		if reservedNames[key] {
+			c.errorf(pos, "%s is reserved by the generated code", name)
+		}
+		if prev, ok := c.symbols[key]; ok {
+			c.errorf(pos, "%s redeclared, previous declaration at %s", name, prev.where(c.p))
+			return
+		}
+		c.symbols[key] = symbol{kind: kind, file: c.p, pos: pos}
+	}
+
+	for _, es := range c.p.EnumStats {
+		declare(es.Name, symbolEnum, es.Pos)
+	}
+	for _, ms := range c.p.MessageStats {
+		declare(ms.Name, symbolMessage, ms.Pos)
+	}
+	for _, ss := range c.p.ServiceStats {
+		declare(ss.Name, symbolService, ss.Pos)
+	}
+}
+
+// checkName reports the name which is not a valid go identifier, like
+// "user-info", the generated code would not compile
+func (c *checker) checkName(name string, pos Position) {
+	if !isIdentifier(name) {
+		c.errorf(pos, "invalid name %s, must be a letter or '_' followed by letters, digits or '_'", name)
+	}
+}
+
+// reservedNames are declared by the generated code in the package of the file,
+// so they can't be used by the enums, messages, services and enum members
+var reservedNames = map[string]bool{
+	// the transport of the streaming methods
+	"Stream":       true,
+	"StreamServer": true,
+	"StreamDialer": true,
+	// the request metadata of -ctx mode
+	"Metadata":            true,
+	"NewOutgoingContext":  true,
+	"FromOutgoingContext": true,
+	"FromIncomingContext": true,
+	// the serialization and the decode limits
+	"Serializer":           true,
+	"DecodeOptions":        true,
+	"DefaultDecodeOptions": true,
+	// the interceptors, mocks and gateways of the services
+	"Interceptor":        true,
+	"Invoker":            true,
+	"MockCall":           true,
+	"MaxGatewayBodySize": true,
+}
+
+// knownOptions are the options which can be declared in a file
+var knownOptions = map[string]bool{
+	"go_package": true,
+}
+
+// knownMethodOptions are the options which can be declared for a method
+var knownMethodOptions = map[string]bool{
+	"http_method": true,
+	"http_path":   true,
+}
+
+var httpMethods = map[string]bool{
+	"GET":    true,
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+func (c *checker) checkOptions() {
+	options := make(map[string]Position)
+	for _, os := range c.p.OptionStats {
+		if !knownOptions[os.Name] {
+			c.errorf(os.Pos, "unknown option %s", os.Name)
+			continue
+		}
+		if prev, ok := options[os.Name]; ok {
+			c.errorf(os.Pos, "option %s redeclared, previous declaration at %d:%d", os.Name, prev.Line, prev.Column)
+			continue
+		}
+		options[os.Name] = os.Pos
+
+		if os.Name == "go_package" {
+			c.checkGoPackage(os)
+		}
+	}
+}
+
+// the value of go_package is the import path of the generated go package,
+// optionally followed by ";" and the package name, like
+// "github.com/acme/gen/user;user"
+func (c *checker) checkGoPackage(os *OptionStat) {
+	importPath, name, _ := strings.Cut(os.Value, ";")
+	if importPath == "" || strings.ContainsAny(importPath, " \t\\") || strings.HasSuffix(importPath, "/") {
+		c.errorf(os.Pos, "invalid go_package %q, invalid import path", os.Value)
+	} else if strings.Contains(os.Value, ";") && (!isIdentifier(name) || gotoken.IsKeyword(name)) {
+		c.errorf(os.Pos, "invalid go_package %q, invalid package name", os.Value)
+	}
+}
+
+func (c *checker) checkEnum(es *EnumStat) {
+	members := make(map[string]Position)
+	values := make(map[int64]*EnumMember)
+	for _, m := range es.Members {
+		c.checkName(m.Name, m.Pos)
+		if prev, ok := members[m.Name]; ok {
+			c.errorf(m.Pos, "duplicate member %s in enum %s, previous declaration at %d:%d", m.Name, es.Name, prev.Line, prev.Column)
+		} else if prev, ok := c.enumMembers[m.Name]; ok {
+			c.errorf(m.Pos, "member %s of enum %s conflicts with the member of enum %s", m.Name, es.Name, prev.Name)
+		} else if reservedNames[m.Name] {
+			c.errorf(m.Pos, "member %s of enum %s is reserved by the generated code", m.Name, es.Name)
+		} else if sym, ok := c.symbols[m.Name]; ok && sym.file == c.p {
+			c.errorf(m.Pos, "member %s of enum %s conflicts with the declaration at %s", m.Name, es.Name, sym.where(c.p))
+		} else {
+			members[m.Name] = m.Pos
+			c.enumMembers[m.Name] = es
+		}
+
+		// enum is encoded as uint32
+		if m.Value < 0 || m.Value > math.MaxUint32 {
+			c.errorf(m.ValuePos, "value %d of %s is out of range, enum value must be between 0 and %d", m.Value, m.Name, uint32(math.MaxUint32))
+		} else if prev, ok := values[m.Value]; ok {
+			c.errorf(m.ValuePos, "duplicate value %d in enum %s, also used by %s", m.Value, es.Name, prev.Name)
+		} else {
+			values[m.Value] = m
+		}
+	}
+}
+
+func (c *checker) checkMessage(ms *MessageStat) {
+	names := make(map[string]Position)
+	seqs := make(map[uint8]Position)
+	for _, m := range ms.Members {
+		c.checkName(m.Name, m.Pos)
+		if prev, ok := names[m.Name]; ok {
+			c.errorf(m.Pos, "duplicate field %s in message %s, previous declaration at %d:%d", m.Name, ms.Name, prev.Line, prev.Column)
+		} else {
+			names[m.Name] = m.Pos
+		}
+
+		if prev, ok := seqs[m.Seq]; ok {
+			c.errorf(m.SeqPos, "duplicate seq %d in message %s, previous use at %d:%d", m.Seq, ms.Name, prev.Line, prev.Column)
+		} else {
+			seqs[m.Seq] = m.SeqPos
+		}
+
+		c.checkType(m.Type, m.TypePos)
+	}
+}
+
+func (c *checker) checkType(typ interface{}, pos Position) {
+	switch v := typ.(type) {
+	case MapType:
+		// encoding/json can't encode the keys of bool and float
+		switch v.Key {
+		case "bytes", "bool", "float32", "float64":
+			c.errorf(pos, "%s cannot be the key of map", v.Key)
+		}
+		c.checkType(v.Val, pos)
+	case ListType:
+		c.checkType(v.Ele, pos)
+	case string:
+		if IsBuiltin(v) {
+			return
+		}
+		sym, ok := c.symbols[utils.FirstUpper(v)]
+		if !ok {
+			c.errorf(pos, "undefined type %s", v)
+		} else if sym.kind == symbolService {
+			c.errorf(pos, "%s is a service, not a type", v)
+		}
+	}
+}
+
+func (c *checker) checkService(ss *ServiceStat) {
+	methods := make(map[string]Position)
+	routes := make(map[string]string)
+	for _, m := range ss.Members {
+		c.checkName(m.Name, m.Pos)
+		prev, duplicate := methods[m.Name]
+		if duplicate {
+			c.errorf(m.Pos, "duplicate method %s in service %s, previous declaration at %d:%d", m.Name, ss.Name, prev.Line, prev.Column)
+		} else {
+			methods[m.Name] = m.Pos
+		}
+
+		c.checkMessageRef(m.Req, m.ReqPos)
+		if m.Resp != "" {
+			c.checkMessageRef(m.Resp, m.RespPos)
+		}
+		if m.ReqStream && m.Resp == "" {
+			c.errorf(m.Pos, "streaming method %s must return a response", m.Name)
+		}
+		if (m.ReqStream || m.RespStream) && len(m.Throws) != 0 {
+			c.errorf(m.ThrowsPos[0], "streaming method %s cannot throw errors", m.Name)
+		}
+
+		throws := make(map[string]Position)
+		for i, name := range m.Throws {
+			pos := m.ThrowsPos[i]
+			if prev, ok := throws[name]; ok {
+				c.errorf(pos, "duplicate error %s in method %s, previous declaration at %d:%d", name, m.Name, prev.Line, prev.Column)
+				continue
+			}
+			throws[name] = pos
+			c.checkMessageRef(name, pos)
+			c.checkError(name, pos)
+		}
+
+		c.checkMethodOptions(m)
+		if duplicate || m.ReqStream || m.RespStream {
+			continue
+		}
+		method, path := ss.HTTPRoute(m)
+		route := method + " " + path
+		if prev, ok := routes[route]; ok {
+			c.errorf(m.Pos, "route %s of method %s conflicts with method %s", route, m.Name, prev)
+		} else {
+			routes[route] = m.Name
+		}
+	}
+}
+
+func (c *checker) checkMethodOptions(m ServiceMember) {
+	options := make(map[string]Position)
+	for _, os := range m.Options {
+		if !knownMethodOptions[os.Name] {
+			c.errorf(os.Pos, "unknown option %s", os.Name)
+			continue
+		}
+		if prev, ok := options[os.Name]; ok {
+			c.errorf(os.Pos, "option %s redeclared, previous declaration at %d:%d", os.Name, prev.Line, prev.Column)
+			continue
+		}
+		options[os.Name] = os.Pos
+
+		if m.ReqStream || m.RespStream {
+			c.errorf(os.Pos, "streaming method %s cannot be served over HTTP", m.Name)
+			continue
+		}
+		switch os.Name {
+		case "http_method":
+			if !httpMethods[os.Value] {
+				c.errorf(os.Pos, "invalid http_method %q, must be GET, POST, PUT, PATCH or DELETE", os.Value)
+			}
+		case "http_path":
+			if !strings.HasPrefix(os.Value, "/") || strings.ContainsAny(os.Value, " \t?#") {
+				c.errorf(os.Pos, "invalid http_path %q", os.Value)
+			}
+		}
+	}
+}
+
+// checkError reports the thrown message having a field named Error, it would
+// conflict with the Error method implementing error
+func (c *checker) checkError(name string, pos Position) {
+	key := utils.FirstUpper(name)
+	sym, ok := c.symbols[key]
+	if !ok || sym.kind != symbolMessage || c.errors[key] {
+		return
+	}
+	c.errors[key] = true
+	for _, ms := range sym.file.MessageStats {
+		if ms.Name != key {
+			continue
+		}
+		for _, m := range ms.Members {
+			if m.Name != "Error" {
+				continue
+			}
+			if sym.file == c.p {
+				pos = m.Pos
+			}
+			c.errorf(pos, "field Error of message %s conflicts with the Error method of the thrown message", ms.Name)
+		}
+	}
+}
+
+func (c *checker) checkMessageRef(name string, pos Position) {
+	sym, ok := c.symbols[utils.FirstUpper(name)]
+	if !ok {
+		c.errorf(pos, "undefined message %s", name)
+	} else if sym.kind != symbolMessage {
+		c.errorf(pos, "%s is not a message", name)
+	}
+}
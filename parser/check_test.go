@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func check(t *testing.T, src string) Diagnostics {
+	t.Helper()
+
+	p := NewParser("test.dgen", strings.NewReader(src))
+	if err := p.Parse(); err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	err := Check(p)
+	if err == nil {
+		return nil
+	}
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("expected Diagnostics, got %T: %v", err, err)
+	}
+	return diags
+}
+
+func TestCheck(t *testing.T) {
+	if diags := check(t, testIDL); diags != nil {
+		t.Fatalf("unexpected errors:\n%s", diags)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"message A { seq=1 B b; }", "test.dgen:1:19: undefined type B"},
+		{"message A { seq=1 list[map[string]B] b; }", "test.dgen:1:19: undefined type B"},
+		{"service S {}\nmessage A { seq=1 S s; }", "test.dgen:2:19: S is a service, not a type"},
+		{"message A { seq=1 int32 a; seq=1 int32 b; }", "test.dgen:1:32: duplicate seq 1 in message A, previous use at 1:17"},
+		{"message A { seq=1 int32 a; seq=2 int32 a; }", "test.dgen:1:40: duplicate field A in message A, previous declaration at 1:25"},
+		{"message A {}\nmessage a {}", "test.dgen:2:9: A redeclared, previous declaration at 1:9"},
+		{"message String {}", "test.dgen:1:9: String conflicts with the builtin type string"},
+		{"enum Bool { a }", "test.dgen:1:6: Bool conflicts with the builtin type bool"},
+		{"message stream {}\nservice S { Call(stream stream) return (stream); }", "test.dgen:1:9: Stream is reserved by the generated code"},
+		{"message metadata {}", "test.dgen:1:9: Metadata is reserved by the generated code"},
+		{"message decodeOptions {}", "test.dgen:1:9: DecodeOptions is reserved by the generated code"},
+		{"service interceptor {}", "test.dgen:1:9: Interceptor is reserved by the generated code"},
+		{"enum E { streamDialer }", "test.dgen:1:10: member StreamDialer of enum E is reserved by the generated code"},
+		{"message user-info {}", "test.dgen:1:9: invalid name User-info, must be a letter or '_' followed by letters, digits or '_'"},
+		{"message A { seq=1 string first-name; }", "test.dgen:1:26: invalid name First-name, must be a letter or '_' followed by letters, digits or '_'"},
+		{"enum E { a.b }", "test.dgen:1:10: invalid name A.b, must be a letter or '_' followed by letters, digits or '_'"},
+		{"message A {}\nservice S { get-user(A); }", "test.dgen:2:13: invalid name Get-user, must be a letter or '_' followed by letters, digits or '_'"},
+		{"enum E { x, y, x }", "test.dgen:1:16: duplicate member X in enum E, previous declaration at 1:10"},
+		{"enum E { x }\nservice S { Call(E); }", "test.dgen:2:18: E is not a message"},
+		{"message A {}\nservice S { Call(A) return (B); }", "test.dgen:2:29: undefined message B"},
+		{"message A {}\nservice S { call(A); Call(A); }", "test.dgen:2:22: duplicate method Call in service S, previous declaration at 2:13"},
+		{"message A {}\nservice S { Call(A); Call(A); }", "test.dgen:2:22: duplicate method Call in service S, previous declaration at 2:13"},
+		{"message A {}\nservice S { Call(A) return (A) throws (B); }", "test.dgen:2:40: undefined message B"},
+		{"message A {}\nservice S { Call(A) return (A) throws (A, a); }", "test.dgen:2:43: duplicate error A in method Call, previous declaration at 2:40"},
+		{"message A {}\nservice S { Call(stream A); }", "test.dgen:2:13: streaming method Call must return a response"},
+		{"message A {}\nmessage E { seq=1 string error; }\nservice S { Call(A) return (A) throws (E); Get(A) return (A) throws (E); }", "test.dgen:2:26: field Error of message E conflicts with the Error method of the thrown message"},
+		{"message A {}\nservice S { Call(A) return (stream A) throws (A); }", "test.dgen:2:47: streaming method Call cannot throw errors"},
+		{"message A {}\nservice S { Call(A) [http_verb = \"GET\"]; }", "test.dgen:2:22: unknown option http_verb"},
+		{"message A {}\nservice S { Call(A) [http_method = \"get\"]; }", "test.dgen:2:22: invalid http_method \"get\", must be GET, POST, PUT, PATCH or DELETE"},
+		{"message A {}\nservice S { Call(A) [http_path = \"users\"]; }", "test.dgen:2:22: invalid http_path \"users\""},
+		{"message A {}\nservice S { A(A) [http_path = \"/S/B\"]; B(A); }", "test.dgen:2:40: route POST /S/B of method B conflicts with method A"},
+		{"message A { seq=1 map[bytes]int32 m; }", "test.dgen:1:19: bytes cannot be the key of map"},
+		{"message A { seq=1 map[bool]int32 m; }", "test.dgen:1:19: bool cannot be the key of map"},
+		{"message A { seq=1 list[map[float64]int32] m; }", "test.dgen:1:19: float64 cannot be the key of map"},
+		{"enum E { a = 1, b, c = 2 }", "test.dgen:1:24: duplicate value 2 in enum E, also used by B"},
+		{"enum E { a = -1 }", "test.dgen:1:14: value -1 of A is out of range, enum value must be between 0 and 4294967295"},
+		{"enum E { a = 4294967296 }", "test.dgen:1:14: value 4294967296 of A is out of range, enum value must be between 0 and 4294967295"},
+		{"enum E { a }\nenum F { a = 1 }", "test.dgen:2:10: member A of enum F conflicts with the member of enum E"},
+		{"enum E { a }\nmessage A {}", "test.dgen:1:10: member A of enum E conflicts with the declaration at 2:9"},
+		{"option java_package = \"x\";", "test.dgen:1:8: unknown option java_package"},
+		{"option go_package = \"a/b\";\noption go_package = \"a/c\";", "test.dgen:2:8: option go_package redeclared, previous declaration at 1:8"},
+		{"option go_package = \"a/b;type\";", "test.dgen:1:8: invalid go_package \"a/b;type\", invalid package name"},
+		{"option go_package = \";b\";", "test.dgen:1:8: invalid go_package \";b\", invalid import path"},
+	}
+
+	for _, test := range tests {
+		diags := check(t, test.src)
+		if len(diags) != 1 {
+			t.Errorf("%q: expected 1 error, got %d: %v", test.src, len(diags), diags)
+			continue
+		}
+		if got := diags[0].Error(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.src, got, test.want)
+		}
+	}
+}
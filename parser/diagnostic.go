@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diagnostic describes a problem found in an IDL file.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`   // 1-based, 0 if the problem has no position
+	Column   int    `json:"column,omitempty"` // 1-based, counted in bytes
+	Message  string `json:"message"`
+	Expected string `json:"expected,omitempty"`
+	Found    string `json:"found,omitempty"`
+	Source   string `json:"source,omitempty"` // the source line where the problem is
+}
+
+// Error returns the message prefixed by the position, the line and the column
+// are omitted if they are unknown.
+func (d *Diagnostic) Error() string {
+	switch {
+	case d.Line == 0:
+		return fmt.Sprintf("%s: %s", d.File, d.Message)
+	case d.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+}
+
+// Render returns the error message followed by the source line and a caret
+// pointing at the column.
+func (d *Diagnostic) Render() string {
+	if d.Source == "" || d.Column == 0 {
+		return d.Error()
+	}
+
+	caret := []byte{}
+	for i := 0; i < d.Column-1 && i < len(d.Source); i++ {
+		// keep tabs so that the caret lines up with the source line
+		if d.Source[i] == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+	caret = append(caret, '^')
+
+	return fmt.Sprintf("%s\n%s\n%s", d.Error(), d.Source, caret)
+}
+
+// Diagnostics is a list of diagnostics which is reported as one error.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	s := make([]string, 0, len(ds))
+	for _, d := range ds {
+		s = append(s, d.Render())
+	}
+	return strings.Join(s, "\n")
+}
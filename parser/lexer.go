@@ -1,80 +1,128 @@
 package parser
 
 import (
-	"bufio"
 	"io"
+	"strings"
 )
 
 type lexer struct {
-	row    int // 当前行
-	column int // 当前列
+	line   int // 当前行, 从1开始
+	column int // 当前列, 从1开始
 
-	buf    *bufio.Reader
+	rd     io.Reader
+	lines  []string // 源文件的每一行, 用于输出错误信息
 	tokens []token
 }
 
 func NewLexer(rd io.Reader) *lexer {
 	return &lexer{
-		buf: bufio.NewReader(rd),
+		rd: rd,
 	}
 }
 
 func (lex *lexer) Scan() error {
-	err := lex.scanToken()
-	if err == io.EOF {
-		return nil
+	src, err := io.ReadAll(lex.rd)
+	if err != nil {
+		return err
+	}
+
+	lex.lines = strings.Split(string(src), "\n")
+	for i, line := range lex.lines {
+		lex.lines[i] = strings.TrimSuffix(line, "\r")
 	}
-	return err
-}
 
-func (lex *lexer) skipComment() error {
-	_, _, err := lex.buf.ReadLine()
-	lex.row++
-	lex.column = 0
+	lex.scanToken(src)
+	return nil
+}
 
-	return err
+// sourceLine returns the content of the given 1-based line.
+func (lex *lexer) sourceLine(line int) string {
+	if line < 1 || line > len(lex.lines) {
+		return ""
+	}
+	return lex.lines[line-1]
 }
 
-func (lex *lexer) scanToken() error {
+func (lex *lexer) scanToken(src []byte) {
+	lex.line, lex.column = 1, 1
+
 	s := []byte{}
-	for {
-		b, err := lex.buf.ReadByte()
-		if err != nil {
-			return err
+	column := 0 // the column where s starts
+	flush := func() {
+		if len(s) != 0 {
+			lex.addToken(string(s), column)
+			s = []byte{}
 		}
+	}
 
-		if _, ok := tokenTypeMap[string(b)]; ok {
-			if len(s) != 0 {
-				lex.addToken(string(s))
-				s = []byte{}
-			}
-			lex.addToken(string(b))
+	for i := 0; i < len(src); i++ {
+		b := src[i]
+
+		if b == '"' {
+			flush()
+			i = lex.scanString(src, i)
+		} else if _, ok := tokenTypeMap[string(b)]; ok {
+			flush()
+			lex.addToken(string(b), lex.column)
+			lex.column++
 		} else if _, ok := ignoreCharMap[b]; ok {
-			if len(s) != 0 {
-				lex.addToken(string(s))
-				s = []byte{}
-			}
+			flush()
 			switch b {
 			case '\n':
-				lex.column = 0
-				lex.row++
+				lex.column = 1
+				lex.line++
 			case '#':
-				lex.skipComment()
+				// skip the comment until the end of line
+				for i+1 < len(src) && src[i+1] != '\n' {
+					i++
+				}
 			default:
 				lex.column++
 			}
 		} else {
+			if len(s) == 0 {
+				column = lex.column
+			}
 			s = append(s, b)
+			lex.column++
 		}
 	}
+	flush()
 }
 
-func (lex *lexer) addToken(s string) {
+// scanString scans the string literal starting at src[start] and returns the
+// index of its last byte. A string must be closed on the same line, otherwise
+// the scanned bytes become a T_Illegal token.
+func (lex *lexer) scanString(src []byte, start int) int {
+	end := start + 1
+	for end < len(src) && src[end] != '"' && src[end] != '\n' {
+		end++
+	}
+
 	token := token{
-		val:    s,
-		row:    lex.row,
+		typ:    T_String,
+		line:   lex.line,
 		column: lex.column,
 	}
+	if end < len(src) && src[end] == '"' {
+		token.val = string(src[start : end+1])
+	} else {
+		token.typ = T_Illegal
+		token.val = string(src[start:end])
+		end-- // leave the newline to the caller
+	}
+
+	lex.tokens = append(lex.tokens, token)
+	lex.column += len(token.val)
+	return end
+}
+
+func (lex *lexer) addToken(s string, column int) {
+	token := token{
+		val:    s,
+		line:   lex.line,
+		column: column,
+	}
 
 	if typ, ok := tokenTypeMap[s]; ok {
 		token.typ = typ
@@ -84,6 +132,5 @@ func (lex *lexer) addToken(s string) {
 		token.typ = T_Identifier
 	}
 
-	lex.column += len(s)
 	lex.tokens = append(lex.tokens, token)
 }
@@ -39,6 +39,33 @@ func TestLexer(t *testing.T) {
 	}
 
 	for _, token := range lexer.tokens {
-		t.Logf("raw:%d, column%d, tokenType:%d, token.val: %s \n", token.row, token.column, token.typ, token.val)
+		t.Logf("line:%d, column:%d, tokenType:%s, token.val: %s \n", token.line, token.column, token.typ, token.val)
+	}
+}
+
+func TestLexerPosition(t *testing.T) {
+	s := "# comment\nmessage A {# comment\n\tseq=1 string name;\n}"
+
+	lexer := NewLexer(strings.NewReader(s))
+	if err := lexer.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		val          string
+		line, column int
+	}{
+		{"message", 2, 1}, {"A", 2, 9}, {"{", 2, 11},
+		{"seq", 3, 2}, {"=", 3, 5}, {"1", 3, 6}, {"string", 3, 8}, {"name", 3, 15}, {";", 3, 19},
+		{"}", 4, 1},
+	}
+	if len(lexer.tokens) != len(want) {
+		t.Fatalf("expected %d tokens, got %d", len(want), len(lexer.tokens))
+	}
+	for i, w := range want {
+		token := lexer.tokens[i]
+		if token.val != w.val || token.line != w.line || token.column != w.column {
+			t.Errorf("token %d: got %s at %d:%d, want %s at %d:%d", i, token.val, token.line, token.column, w.val, w.line, w.column)
+		}
 	}
 }
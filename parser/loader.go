@@ -0,0 +1,126 @@
+package parser
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type loader struct {
+	includePaths []string
+
+	files    map[string]*Parser // parsed files, keyed by absolute path
+	visiting map[string]bool    // files on the current import chain
+	chain    []string
+	order    []*Parser
+	diags    Diagnostics
+}
+
+// Load parses filename and every file it imports. An import path is resolved
+// relative to the directory of the importing file first, then relative to
+// each of the include paths. The files are returned in dependency order: an
+// imported file always comes before the files importing it, and filename is
+// the last one.
+func Load(filename string, includePaths []string) ([]*Parser, error) {
+	l := &loader{
+		includePaths: includePaths,
+		files:        make(map[string]*Parser),
+		visiting:     make(map[string]bool),
+	}
+
+	p, err := l.parseFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	l.load(p)
+
+	if len(l.diags) != 0 {
+		return nil, l.diags
+	}
+	return l.order, nil
+}
+
+func (l *loader) parseFile(filename string) (*Parser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := NewParser(filename, f)
+	l.files[absPath(filename)] = p
+	return p, p.Parse()
+}
+
+func (l *loader) load(p *Parser) {
+	key := absPath(p.Filename)
+	l.visiting[key] = true
+	l.chain = append(l.chain, p.Filename)
+
+	for _, is := range p.ImportStats {
+		filename, ok := l.resolve(p.Filename, is.Path)
+		if !ok {
+			l.diags = append(l.diags, p.errorAt(is.Pos, "cannot find imported file %s", is.Path))
+			continue
+		}
+
+		depKey := absPath(filename)
+		if l.visiting[depKey] {
+			chain := append([]string{}, l.chain[l.indexOf(depKey):]...)
+			chain = append(chain, filename)
+			l.diags = append(l.diags, p.errorAt(is.Pos, "import cycle: %s", strings.Join(chain, " -> ")))
+			continue
+		}
+		if dep, ok := l.files[depKey]; ok {
+			is.File = dep
+			continue
+		}
+
+		dep, err := l.parseFile(filename)
+		if err != nil {
+			var diags Diagnostics
+			if errors.As(err, &diags) {
+				l.diags = append(l.diags, diags...)
+			} else {
+				l.diags = append(l.diags, p.errorAt(is.Pos, "%s", err))
+			}
+			continue
+		}
+		is.File = dep
+		l.load(dep)
+	}
+
+	l.visiting[key] = false
+	l.chain = l.chain[:len(l.chain)-1]
+	l.order = append(l.order, p)
+}
+
+// resolve the import path to a file name
+func (l *loader) resolve(importer string, path string) (string, bool) {
+	dirs := append([]string{filepath.Dir(importer)}, l.includePaths...)
+	for _, dir := range dirs {
+		filename := filepath.Join(dir, path)
+		if info, err := os.Stat(filename); err == nil && !info.IsDir() {
+			return filename, true
+		}
+	}
+	return "", false
+}
+
+// indexOf returns the index of the file in the current import chain
+func (l *loader) indexOf(key string) int {
+	for i, filename := range l.chain {
+		if absPath(filename) == key {
+			return i
+		}
+	}
+	return 0
+}
+
+func absPath(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filepath.Clean(filename)
+}
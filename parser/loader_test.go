@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"api/api.dgen":             "import \"common/types.dgen\";\nimport \"status.dgen\";\nmessage Req { seq=1 User user; seq=2 Status status; }",
+		"api/status.dgen":          "enum Status { ok, failed }",
+		"shared/common/types.dgen": "message User { seq=1 string name; }",
+	})
+
+	files, err := Load(filepath.Join(dir, "api/api.dgen"), []string{filepath.Join(dir, "shared")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || !strings.HasSuffix(files[2].Filename, "api.dgen") {
+		t.Fatalf("unexpected files: %v", files)
+	}
+	for _, f := range files {
+		if err := Check(f); err != nil {
+			t.Errorf("check %s failed: %s", f.Filename, err)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		files map[string]string
+		want  string
+	}{
+		{
+			map[string]string{"a.dgen": "import \"b.dgen\";"},
+			"a.dgen:1:8: cannot find imported file b.dgen",
+		},
+		{
+			map[string]string{"a.dgen": "import \"b.dgen\";", "b.dgen": "import \"c.dgen\";", "c.dgen": "import \"a.dgen\";"},
+			"c.dgen:1:8: import cycle: a.dgen -> b.dgen -> c.dgen -> a.dgen",
+		},
+		{
+			map[string]string{"a.dgen": "import \"b.dgen\";", "b.dgen": "message B {"},
+			"b.dgen:1:12: expected 'seq', found end of file",
+		},
+	}
+
+	for _, test := range tests {
+		dir := writeFiles(t, test.files)
+		_, err := Load(filepath.Join(dir, "a.dgen"), nil)
+		diags, ok := err.(Diagnostics)
+		if !ok || len(diags) != 1 {
+			t.Errorf("expected 1 diagnostic, got %v", err)
+			continue
+		}
+		if got := strings.ReplaceAll(diags[0].Error(), dir+string(filepath.Separator), ""); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestCheckImport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.dgen": "import \"b.dgen\";\nimport \"c.dgen\";\nmessage A { seq=1 C c; }\nmessage B {}",
+		"b.dgen": "message B {}",
+		"c.dgen": "import \"d.dgen\";\nmessage C { seq=1 D d; }",
+		"d.dgen": "message D {}",
+	})
+
+	files, err := Load(filepath.Join(dir, "a.dgen"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(files[len(files)-1]); err == nil {
+		t.Fatal("expected errors")
+	} else if got := strings.ReplaceAll(err.Error(), dir+string(filepath.Separator), ""); !strings.Contains(got, "a.dgen:4:9: B redeclared, previous declaration at b.dgen:1:9") {
+		t.Errorf("unexpected errors:\n%s", got)
+	}
+
+	// the types of indirectly imported files are not visible
+	dir = writeFiles(t, map[string]string{
+		"a.dgen": "import \"c.dgen\";\nmessage A { seq=1 D d; }",
+		"c.dgen": "import \"d.dgen\";\nmessage C { seq=1 D d; }",
+		"d.dgen": "message D {}",
+	})
+	files, err = Load(filepath.Join(dir, "a.dgen"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(files[len(files)-1]); err == nil || !strings.Contains(err.Error(), "undefined type D") {
+		t.Errorf("expected undefined type D, got %v", err)
+	}
+}
@@ -4,21 +4,30 @@ import (
 	"dgen/utils"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"strings"
 )
 
 type Parser struct {
+	Filename     string
+	Package      string // the package declared by the file, like "user.api"
+	ImportStats  []*ImportStat
+	OptionStats  []*OptionStat
 	EnumStats    []*EnumStat
 	MessageStats []*MessageStat
 	ServiceStats []*ServiceStat
 
-	lexer *lexer
-	cur   int // 目前解析到的token数
+	lexer  *lexer
+	tokens []token
+	cur    int // 目前解析到的token数
+	diags  Diagnostics
 }
 
-func NewParser(rd io.Reader) *Parser {
+func NewParser(filename string, rd io.Reader) *Parser {
 	return &Parser{
-		lexer: NewLexer(rd),
+		Filename: filename,
+		lexer:    NewLexer(rd),
 	}
 }
 
@@ -26,13 +35,23 @@ func (p *Parser) Parse() error {
 	if err := p.lexer.Scan(); err != nil {
 		return err
 	}
+	p.tokens = p.lexer.tokens
 
-	tokens := p.lexer.tokens
-	for p.cur < len(tokens) {
-		token := tokens[p.cur]
-		p.cur++
+	for {
+		token := p.keyword(p.next(), T_Package, T_Option)
 		var err error
 		switch token.typ {
+		case T_EOF:
+			if len(p.diags) != 0 {
+				return p.diags
+			}
+			return nil
+		case T_Package:
+			err = p.parsePackage(token)
+		case T_Import:
+			err = p.parseImport()
+		case T_Option:
+			err = p.parseOption()
 		case T_Enum:
 			err = p.parseEnum()
 		case T_Message:
@@ -40,131 +59,284 @@ func (p *Parser) Parse() error {
 		case T_Service:
 			err = p.parseService()
 		default:
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+			err = p.unexpected(token, "'package', 'import', 'option', 'enum', 'message' or 'service'")
 		}
 
 		if err != nil {
-			return err
+			p.diags = append(p.diags, err.(*Diagnostic))
+			p.synchronize()
+		}
+	}
+}
+
+// synchronize skips tokens until the beginning of the next declaration, so
+// that the errors in the following declarations can be reported too. package
+// and option only begin a declaration after the end of the previous one, so a
+// field named option in a broken message is skipped.
+func (p *Parser) synchronize() {
+	for {
+		token := p.peek()
+		if p.cur > 0 {
+			switch p.tokens[p.cur-1].typ {
+			case T_Semicolon, T_RCurlyBracket:
+				token = p.keyword(token, T_Package, T_Option)
+			}
+		}
+		switch token.typ {
+		case T_EOF, T_Package, T_Import, T_Option, T_Enum, T_Message, T_Service:
+			return
+		}
+		p.next()
+	}
+}
+
+// keyword returns the token as the keyword if it is an identifier spelled as
+// one of the contextual keywords kinds, which are only keywords at the current
+// position.
+func (p *Parser) keyword(t token, kinds ...tokenType) token {
+	if t.typ != T_Identifier {
+		return t
+	}
+	for _, kind := range kinds {
+		if contextualKeywords[t.val] == kind {
+			t.typ = kind
 		}
 	}
+	return t
+}
+
+// stream consumes the stream keyword of a method signature. stream is only a
+// keyword right after '(' and followed by the message name, so "(stream)" still
+// refers to a message named stream.
+func (p *Parser) stream() bool {
+	if p.keyword(p.peek(), T_Stream).typ != T_Stream || p.cur+1 >= len(p.tokens) || p.tokens[p.cur+1].typ != T_Identifier {
+		return false
+	}
+	p.next()
+	return true
+}
+
+// peek returns the current token without consuming it. Once all tokens are
+// consumed it returns a T_EOF token positioned right after the last one.
+func (p *Parser) peek() token {
+	if p.cur < len(p.tokens) {
+		return p.tokens[p.cur]
+	}
+
+	eof := token{typ: T_EOF, line: 1, column: 1}
+	if len(p.tokens) != 0 {
+		last := p.tokens[len(p.tokens)-1]
+		eof.line = last.line
+		eof.column = last.column + len(last.val)
+	}
+	return eof
+}
+
+// next consumes and returns the current token.
+func (p *Parser) next() token {
+	token := p.peek()
+	if token.typ != T_EOF {
+		p.cur++
+	}
+	return token
+}
+
+// expect consumes the current token if its type is typ, otherwise it returns
+// an error and leaves the cursor untouched.
+func (p *Parser) expect(typ tokenType) (token, error) {
+	token := p.peek()
+	if token.typ != typ {
+		return token, p.unexpected(token, typ.String())
+	}
+	p.cur++
+	return token, nil
+}
+
+// errorf returns a diagnostic positioned at the token.
+func (p *Parser) errorf(token token, format string, args ...interface{}) *Diagnostic {
+	return p.errorAt(token.pos(), format, args...)
+}
+
+// errorAt returns a diagnostic positioned at pos of this file.
+func (p *Parser) errorAt(pos Position, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{
+		File:    p.Filename,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: fmt.Sprintf(format, args...),
+		Source:  p.lexer.sourceLine(pos.Line),
+	}
+}
+
+func (p *Parser) unexpected(token token, expected string) *Diagnostic {
+	var d *Diagnostic
+	if token.typ == T_Illegal {
+		d = p.errorf(token, "expected %s, found unterminated string %s", expected, token)
+	} else {
+		d = p.errorf(token, "expected %s, found %s", expected, token)
+	}
+	d.Expected = expected
+	d.Found = token.String()
+	return d
+}
+
+// Option returns the value of the option declared in the file
+func (p *Parser) Option(name string) (string, bool) {
+	for _, os := range p.OptionStats {
+		if os.Name == name {
+			return os.Value, true
+		}
+	}
+	return "", false
+}
+
+func (p *Parser) parsePackage(keyword token) error {
+	if p.Package != "" {
+		return p.errorf(keyword, "package redeclared")
+	}
+
+	token, err := p.expect(T_Identifier)
+	if err != nil {
+		return err
+	}
+	for _, s := range strings.Split(token.val, ".") {
+		if !isIdentifier(s) {
+			return p.errorf(token, "invalid package name %s", token.val)
+		}
+	}
+	p.Package = token.val
+
+	if _, err := p.expect(T_Semicolon); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *Parser) parseOption() error {
+	os := &OptionStat{}
+
+	token, err := p.expect(T_Identifier)
+	if err != nil {
+		return err
+	}
+	os.Name = token.val
+	os.Pos = token.pos()
+
+	if _, err := p.expect(T_Assign); err != nil {
+		return err
+	}
+	token, err = p.expect(T_String)
+	if err != nil {
+		return err
+	}
+	os.Value = strings.Trim(token.val, "\"")
+
+	if _, err := p.expect(T_Semicolon); err != nil {
+		return err
+	}
 
+	p.OptionStats = append(p.OptionStats, os)
+	return nil
+}
+
+func (p *Parser) parseImport() error {
+	token, err := p.expect(T_String)
+	if err != nil {
+		return err
+	}
+	is := &ImportStat{
+		Path: strings.Trim(token.val, "\""),
+		Pos:  token.pos(),
+	}
+	if is.Path == "" {
+		return p.errorf(token, "import path cannot be empty")
+	}
+
+	if _, err := p.expect(T_Semicolon); err != nil {
+		return err
+	}
+
+	p.ImportStats = append(p.ImportStats, is)
 	return nil
 }
 
 func (p *Parser) parseEnum() error {
-	tokens := p.lexer.tokens
 	es := &EnumStat{}
 
-	token := tokens[p.cur]
-	if token.typ != T_Identifier || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	token, err := p.expect(T_Identifier)
+	if err != nil {
+		return err
 	}
-	es.Name = token.val
-	p.cur++
+	es.Name = utils.FirstUpper(token.val)
+	es.Pos = token.pos()
 
-	token = tokens[p.cur]
-	if token := tokens[p.cur]; token.typ != T_LCurlyBracket || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_LCurlyBracket); err != nil {
+		return err
 	}
-	p.cur++
 
-	for p.cur < len(tokens) {
-		token = tokens[p.cur]
-		if token.typ != T_Identifier {
-			break
+	var value int64
+	for p.peek().typ == T_Identifier {
+		token = p.next()
+		m := &EnumMember{
+			Name:     utils.FirstUpper(token.val),
+			Value:    value,
+			Pos:      token.pos(),
+			ValuePos: token.pos(),
 		}
-		es.Members = append(es.Members, utils.FirstUpper(token.val))
-		p.cur++
 
-		token = tokens[p.cur]
-		if token.typ != T_Comma {
+		if p.peek().typ == T_Assign {
+			p.next()
+			token, err := p.expect(T_Num)
+			if err != nil {
+				return err
+			}
+			m.Value, err = strconv.ParseInt(token.val, 10, 64)
+			if err != nil {
+				return p.errorf(token, "invalid enum value %s", token.val)
+			}
+			m.ValuePos = token.pos()
+		}
+		es.Members = append(es.Members, m)
+		value = m.Value + 1
+
+		if p.peek().typ != T_Comma {
 			break
 		}
-		p.cur++
+		p.next()
 	}
 
-	token = tokens[p.cur]
-	if token := tokens[p.cur]; token.typ != T_RCurlyBracket || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_RCurlyBracket); err != nil {
+		return err
 	}
-	p.cur++
 
 	p.EnumStats = append(p.EnumStats, es)
 	return nil
 }
 
 func (p *Parser) parseMessage() error {
-	tokens := p.lexer.tokens
 	ms := &MessageStat{}
 
-	token := tokens[p.cur]
-	if token.typ != T_Identifier || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	token, err := p.expect(T_Identifier)
+	if err != nil {
+		return err
 	}
 	ms.Name = utils.FirstUpper(token.val)
-	p.cur++
+	ms.Pos = token.pos()
 
-	token = tokens[p.cur]
-	if token := tokens[p.cur]; token.typ != T_LCurlyBracket || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_LCurlyBracket); err != nil {
+		return err
 	}
-	p.cur++
-
-	for p.cur < len(tokens) {
-		m := &MessageMember{}
 
-		token := tokens[p.cur]
-		if token.typ == T_RCurlyBracket {
-			p.cur++
+	for {
+		if p.peek().typ == T_RCurlyBracket {
+			p.next()
 			break
 		}
-		if token.typ == T_Optional {
-			p.cur++
-			m.Optional = true
-			token = tokens[p.cur]
-		}
-		if token.typ != T_Seq {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		p.cur++
-
-		token = tokens[p.cur]
-		if token.typ != T_Assign {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		p.cur++
-
-		token = tokens[p.cur]
-		if token.typ != T_Num {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		seq, err := strconv.Atoi(token.val)
-		if err != nil {
-			return fmt.Errorf("raw:%d, column:%d is invalid seq", token.row, token.column)
-		}
-		m.Seq = uint8(seq)
-		p.cur++
 
-		token = tokens[p.cur]
-		typ, err := p.parseType()
-		m.Type = typ
+		m, err := p.parseMessageMember()
 		if err != nil {
 			return err
 		}
-
-		token = tokens[p.cur]
-		if token.typ != T_Identifier {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		m.Name = utils.FirstUpper(token.val)
-		p.cur++
-
-		token = tokens[p.cur]
-		if token.typ != T_Semicolon {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		p.cur++
-
 		ms.Members = append(ms.Members, m)
 	}
 
@@ -172,100 +344,203 @@ func (p *Parser) parseMessage() error {
 	return nil
 }
 
+func (p *Parser) parseMessageMember() (*MessageMember, error) {
+	m := &MessageMember{}
+
+	if p.peek().typ == T_Optional {
+		p.next()
+		m.Optional = true
+	}
+
+	if _, err := p.expect(T_Seq); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(T_Assign); err != nil {
+		return nil, err
+	}
+
+	token, err := p.expect(T_Num)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := strconv.Atoi(token.val)
+	if err != nil || seq < 0 || seq > math.MaxUint8 {
+		return nil, p.errorf(token, "invalid seq %s, seq must be between 0 and %d", token.val, math.MaxUint8)
+	}
+	m.Seq = uint8(seq)
+	m.SeqPos = token.pos()
+
+	m.TypePos = p.peek().pos()
+	typ, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	m.Type = typ
+
+	token, err = p.expect(T_Identifier)
+	if err != nil {
+		return nil, err
+	}
+	m.Name = utils.FirstUpper(token.val)
+	m.Pos = token.pos()
+
+	if _, err := p.expect(T_Semicolon); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
 func (p *Parser) parseService() error {
-	tokens := p.lexer.tokens
 	ss := &ServiceStat{}
 
-	token := tokens[p.cur]
-	if token.typ != T_Identifier || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	token, err := p.expect(T_Identifier)
+	if err != nil {
+		return err
 	}
-	ss.Name = token.val
-	p.cur++
+	ss.Name = utils.FirstUpper(token.val)
+	ss.Pos = token.pos()
 
-	token = tokens[p.cur]
-	if token := tokens[p.cur]; token.typ != T_LCurlyBracket || p.cur >= len(tokens) {
-		return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_LCurlyBracket); err != nil {
+		return err
 	}
-	p.cur++
-
-	for p.cur < len(tokens) {
-		m := ServiceMember{}
 
-		token = tokens[p.cur]
-		if token.typ == T_RCurlyBracket {
-			p.cur++
+	for {
+		if p.peek().typ == T_RCurlyBracket {
+			p.next()
 			break
 		}
-		if token.typ != T_Identifier {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		m.Name = token.val
-		p.cur++
 
-		token = tokens[p.cur]
-		if token.typ != T_LSmallBracket {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+		m, err := p.parseServiceMember()
+		if err != nil {
+			return err
 		}
-		p.cur++
+		ss.Members = append(ss.Members, m)
+	}
 
-		token = tokens[p.cur]
-		if token.typ != T_Identifier {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		m.Req = token.val
-		p.cur++
+	p.ServiceStats = append(p.ServiceStats, ss)
+	return nil
+}
 
-		token = tokens[p.cur]
-		if token.typ != T_RSmallBracket {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-		}
-		p.cur++
+func (p *Parser) parseServiceMember() (ServiceMember, error) {
+	m := ServiceMember{}
+
+	token, err := p.expect(T_Identifier)
+	if err != nil {
+		return m, err
+	}
+	m.Name = utils.FirstUpper(token.val)
+	m.Pos = token.pos()
 
-		token = tokens[p.cur]
-		if token.typ == T_Return {
-			p.cur++
+	if _, err := p.expect(T_LSmallBracket); err != nil {
+		return m, err
+	}
+	m.ReqStream = p.stream()
+	token, err = p.expect(T_Identifier)
+	if err != nil {
+		return m, err
+	}
+	m.Req = utils.FirstUpper(token.val)
+	m.ReqPos = token.pos()
+	if _, err := p.expect(T_RSmallBracket); err != nil {
+		return m, err
+	}
 
-			token = tokens[p.cur]
-			if token.typ != T_LSmallBracket {
-				return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-			}
-			p.cur++
+	if p.peek().typ == T_Return {
+		p.next()
 
-			token = tokens[p.cur]
-			if token.typ != T_Identifier {
-				return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
-			}
-			m.Resp = token.val
-			p.cur++
+		if _, err := p.expect(T_LSmallBracket); err != nil {
+			return m, err
+		}
+		m.RespStream = p.stream()
+		token, err = p.expect(T_Identifier)
+		if err != nil {
+			return m, err
+		}
+		m.Resp = utils.FirstUpper(token.val)
+		m.RespPos = token.pos()
+		if _, err := p.expect(T_RSmallBracket); err != nil {
+			return m, err
+		}
 
-			token = tokens[p.cur]
-			if token.typ != T_RSmallBracket {
-				return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+		if p.peek().typ == T_Throws {
+			p.next()
+			if err := p.parseThrows(&m); err != nil {
+				return m, err
 			}
-			p.cur++
+		}
+	}
 
-			token = tokens[p.cur]
+	if p.peek().typ == T_LBracket {
+		p.next()
+		if err := p.parseMethodOptions(&m); err != nil {
+			return m, err
 		}
-		if token.typ != T_Semicolon {
-			return fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	}
+
+	if _, err := p.expect(T_Semicolon); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// parseThrows parses the error messages of the method, e.g. (NotFound, Invalid)
+func (p *Parser) parseThrows(m *ServiceMember) error {
+	if _, err := p.expect(T_LSmallBracket); err != nil {
+		return err
+	}
+	for {
+		token, err := p.expect(T_Identifier)
+		if err != nil {
+			return err
 		}
-		p.cur++
+		m.Throws = append(m.Throws, utils.FirstUpper(token.val))
+		m.ThrowsPos = append(m.ThrowsPos, token.pos())
 
-		ss.Members = append(ss.Members, m)
+		if p.peek().typ != T_Comma {
+			break
+		}
+		p.next()
 	}
+	_, err := p.expect(T_RSmallBracket)
+	return err
+}
 
-	p.ServiceStats = append(p.ServiceStats, ss)
-	return nil
+// parseMethodOptions parses the options of the method after '[', e.g.
+// [http_method = "GET", http_path = "/users"]
+func (p *Parser) parseMethodOptions(m *ServiceMember) error {
+	for {
+		token, err := p.expect(T_Identifier)
+		if err != nil {
+			return err
+		}
+		os := &OptionStat{Name: token.val, Pos: token.pos()}
+
+		if _, err := p.expect(T_Assign); err != nil {
+			return err
+		}
+		token, err = p.expect(T_String)
+		if err != nil {
+			return err
+		}
+		os.Value = strings.Trim(token.val, "\"")
+		m.Options = append(m.Options, os)
 
+		if p.peek().typ != T_Comma {
+			break
+		}
+		p.next()
+	}
+	_, err := p.expect(T_RBracket)
+	return err
 }
 
 func (p *Parser) parseType() (interface{}, error) {
-	tokens := p.lexer.tokens
-
-	token := tokens[p.cur]
-	p.cur++
-	if token.typ == T_Builtin {
+	token := p.peek()
+	switch token.typ {
+	case T_Builtin:
+		p.next()
 		if token.val == "map" {
 			return p.parseMap()
 		}
@@ -273,37 +548,33 @@ func (p *Parser) parseType() (interface{}, error) {
 			return p.parseList()
 		}
 		return token.val, nil
-	} else if token.typ == T_Identifier {
-		return token.val, nil
-	} else {
-		return nil, fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	case T_Identifier:
+		p.next()
+		// the names of enum and message are capitalised in the generated code
+		return utils.FirstUpper(token.val), nil
+	default:
+		return nil, p.unexpected(token, "type")
 	}
 }
 
 func (p *Parser) parseMap() (interface{}, error) {
-	tokens := p.lexer.tokens
 	m := MapType{}
 
-	token := tokens[p.cur]
-	if token.typ != T_LBracket {
-		return nil, fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_LBracket); err != nil {
+		return nil, err
 	}
-	p.cur++
 
-	token = tokens[p.cur]
+	token := p.peek()
 	if token.typ != T_Builtin || token.val == "map" || token.val == "list" {
-		return nil, fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+		return nil, p.unexpected(token, "builtin scalar type")
 	}
+	p.next()
 	m.Key = token.val
-	p.cur++
 
-	token = tokens[p.cur]
-	if token.typ != T_RBracket {
-		return nil, fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_RBracket); err != nil {
+		return nil, err
 	}
-	p.cur++
 
-	token = tokens[p.cur]
 	typ, err := p.parseType()
 	if err != nil {
 		return nil, err
@@ -314,27 +585,21 @@ func (p *Parser) parseMap() (interface{}, error) {
 }
 
 func (p *Parser) parseList() (interface{}, error) {
-	tokens := p.lexer.tokens
 	l := ListType{}
 
-	token := tokens[p.cur]
-	if token.typ != T_LBracket {
-		return nil, fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_LBracket); err != nil {
+		return nil, err
 	}
-	p.cur++
 
-	token = tokens[p.cur]
 	typ, err := p.parseType()
 	if err != nil {
 		return nil, err
 	}
 	l.Ele = typ
 
-	token = tokens[p.cur]
-	if token.typ != T_RBracket {
-		return nil, fmt.Errorf("raw:%d, column:%d is invalid grammar", token.row, token.column)
+	if _, err := p.expect(T_RBracket); err != nil {
+		return nil, err
 	}
-	p.cur++
 
 	return l, nil
 }
@@ -0,0 +1,205 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+const testIDL = `
+enum fruit {
+	apple,
+	banana = 5,
+	cherry
+}
+
+message HelloRequest {
+	seq=1 string name;
+	optional seq=2 list[map[string]int32] tags;
+}
+
+message HelloResponse {
+	seq=1 string name;
+	optional seq=2 string reply;
+}
+
+service Greeter {
+	SayHello(HelloRequest) return (HelloResponse) [http_method = "GET", http_path = "/hello"];
+	Ping(HelloRequest);
+	Chat(stream HelloRequest) return (stream HelloResponse);
+}
+`
+
+func TestParse(t *testing.T) {
+	p := NewParser("test.dgen", strings.NewReader(testIDL))
+	if err := p.Parse(); err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+
+	if len(p.EnumStats) != 1 || len(p.MessageStats) != 2 || len(p.ServiceStats) != 1 {
+		t.Fatalf("got %d enums, %d messages, %d services", len(p.EnumStats), len(p.MessageStats), len(p.ServiceStats))
+	}
+	if members := p.EnumStats[0].Members; len(members) != 3 || members[1].Value != 5 || members[2].Value != 6 {
+		t.Fatalf("unexpected enum members: %+v", members)
+	}
+	if members := p.ServiceStats[0].Members; len(members) != 3 || members[1].Resp != "" || !members[2].ReqStream || !members[2].RespStream {
+		t.Fatalf("unexpected service members: %+v", members)
+	}
+}
+
+// every prefix of a valid file must either parse or fail with an error
+func TestParseTruncated(t *testing.T) {
+	for i := range testIDL {
+		src := testIDL[:i]
+		p := NewParser("test.dgen", strings.NewReader(src))
+		err := p.Parse()
+		if err == nil && strings.TrimSpace(src) != "" && !strings.HasSuffix(strings.TrimSpace(src), "}") {
+			t.Errorf("truncated input %q parsed without error", src)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		"service",
+		"enum",
+		"enum colors { red,",
+		"message M { seq=1 string",
+		"message M { optional",
+		"message M { seq=256 string name; }",
+		"message M { seq=1 map[list[int32]]string m; }",
+		"message M { seq=1 list[int32 l; }",
+		"service S { Call(Req) return (",
+		"service S { Call(Req) return Resp; }",
+		"service S { Call(Req) throws (E); }",
+		"service S { Call(Req) [http_method]; }",
+		"service S { Call(Req) [http_method = \"GET\"; }",
+		"service S { Call(stream Req Resp); }",
+		"service S { Call(Req) return (Resp stream); }",
+		"service S { Call(Req) return (Resp) throws (); }",
+		"service S { Call(Req) return (Resp) throws (E,); }",
+		"}",
+		"enum E { a = }",
+		"enum E { a = b }",
+	}
+
+	for _, src := range tests {
+		p := NewParser("test.dgen", strings.NewReader(src))
+		if err := p.Parse(); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(testIDL)
+	f.Add("service")
+	f.Add("enum colors { red, green, blue };")
+	f.Add("message M { optional seq=1 map[string]list[M] m; }")
+	f.Add("service S { Call(Req) return (Resp); Notify(Req); }")
+	f.Add("# comment only")
+
+	f.Fuzz(func(t *testing.T, src string) {
+		p := NewParser("test.dgen", strings.NewReader(src))
+		p.Parse()
+	})
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	src := "message A {\n\tseq=1 string name\n}\n\nmessage B {\n\tseq=1 int32 id;\n}\n\nservice S {\n\tCall(A) return B;\n}\n"
+	p := NewParser("test.dgen", strings.NewReader(src))
+	err := p.Parse()
+
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("expected Diagnostics, got %T: %v", err, err)
+	}
+	if len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %d: %v", len(diags), diags)
+	}
+
+	d := diags[0]
+	if d.File != "test.dgen" || d.Line != 3 || d.Column != 1 || d.Expected != "';'" || d.Found != "'}'" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+	d = diags[1]
+	if d.Line != 10 || d.Column != 17 || d.Expected != "'('" || d.Found != "'B'" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+	if want := "test.dgen:10:17: expected '(', found 'B'\n\tCall(A) return B;\n\t               ^"; d.Render() != want {
+		t.Errorf("unexpected render:\n%s\nwant:\n%s", d.Render(), want)
+	}
+
+	// the declaration after the broken one is still parsed
+	if len(p.MessageStats) != 1 || p.MessageStats[0].Name != "B" {
+		t.Errorf("message B is not recovered: %+v", p.MessageStats)
+	}
+}
+
+// contextual keywords can still be used as names outside of their position
+func TestParseContextualKeywords(t *testing.T) {
+	src := "message stream { seq=1 string stream; }\nservice S { Call(stream stream) return (stream); }"
+	p := NewParser("test.dgen", strings.NewReader(src))
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if name := p.MessageStats[0].Members[0].Name; name != "Stream" {
+		t.Errorf("unexpected field name %s", name)
+	}
+	if m := p.ServiceStats[0].Members[0]; !m.ReqStream || m.Req != "Stream" || m.RespStream || m.Resp != "Stream" {
+		t.Errorf("unexpected method: %+v", m)
+	}
+}
+
+func TestParsePackage(t *testing.T) {
+	src := "package user.api;\noption go_package = \"github.com/acme/gen/user/api;userapi\";\nmessage A {}"
+	p := NewParser("test.dgen", strings.NewReader(src))
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Package != "user.api" {
+		t.Errorf("unexpected package %s", p.Package)
+	}
+	if v, ok := p.Option("go_package"); !ok || v != "github.com/acme/gen/user/api;userapi" {
+		t.Errorf("unexpected go_package %s", v)
+	}
+
+	// option and package are only keywords at the top level
+	src = "message option { seq=1 string option; seq=2 string package; }\nmessage package {}"
+	p = NewParser("test.dgen", strings.NewReader(src))
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if members := p.MessageStats[0].Members; members[0].Name != "Option" || members[1].Name != "Package" {
+		t.Errorf("unexpected fields: %+v", members)
+	}
+
+	// a field named option in a broken message does not start a declaration
+	src = "message A { seq=1 int32 ; seq=2 string option; }\nmessage B {}"
+	p = NewParser("test.dgen", strings.NewReader(src))
+	if diags, ok := p.Parse().(Diagnostics); !ok || len(diags) != 1 {
+		t.Errorf("expected 1 diagnostic, got %v", diags)
+	}
+
+	for _, src := range []string{"package a;\npackage b;", "package user-api;", "package a.;", "option go_package = x;"} {
+		p := NewParser("test.dgen", strings.NewReader(src))
+		if err := p.Parse(); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestDiagnosticError(t *testing.T) {
+	tests := []struct {
+		d    Diagnostic
+		want string
+	}{
+		{Diagnostic{File: "a.dgen", Line: 2, Column: 3, Message: "m"}, "a.dgen:2:3: m"},
+		{Diagnostic{File: "a.dgen", Line: 2, Message: "m"}, "a.dgen:2: m"},
+		{Diagnostic{File: "a.dgen", Message: "m"}, "a.dgen: m"},
+	}
+	for _, test := range tests {
+		if got := test.d.Render(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
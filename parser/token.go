@@ -12,8 +12,14 @@ const (
 	T_Seq                            // seq关键字
 	T_Optional                       // option关键字
 	T_Return                         // return关键字
+	T_Throws                         // throws关键字
+	T_Stream                         // stream关键字
+	T_Import                         // import关键字
+	T_Package                        // package关键字
+	T_Option                         // option关键字
 	T_Identifier                     // 标识符
 	T_Num                            // 数字
+	T_String                         // 字符串, 如"common/types.dgen"
 	T_Assign                         // =
 	T_LSmallBracket                  // (
 	T_RSmallBracket                  // )
@@ -23,15 +29,65 @@ const (
 	T_RCurlyBracket                  // }
 	T_Comma                          // ,
 	T_Semicolon                      // ;
+	T_EOF                            // 文件结束
+	T_Illegal                        // 非法token, 如未闭合的字符串
 )
 
 type token struct {
 	typ    tokenType
 	val    string
-	row    int
+	line   int
 	column int
 }
 
+var tokenTypeNames = map[tokenType]string{
+	T_Builtin:       "builtin type",
+	T_Enum:          "'enum'",
+	T_Message:       "'message'",
+	T_Service:       "'service'",
+	T_Seq:           "'seq'",
+	T_Optional:      "'optional'",
+	T_Return:        "'return'",
+	T_Throws:        "'throws'",
+	T_Stream:        "'stream'",
+	T_Import:        "'import'",
+	T_Package:       "'package'",
+	T_Option:        "'option'",
+	T_Identifier:    "identifier",
+	T_Num:           "number",
+	T_String:        "string",
+	T_Assign:        "'='",
+	T_LSmallBracket: "'('",
+	T_RSmallBracket: "')'",
+	T_LBracket:      "'['",
+	T_RBracket:      "']'",
+	T_LCurlyBracket: "'{'",
+	T_RCurlyBracket: "'}'",
+	T_Comma:         "','",
+	T_Semicolon:     "';'",
+	T_EOF:           "end of file",
+	T_Illegal:       "illegal token",
+}
+
+func (typ tokenType) String() string {
+	if name, ok := tokenTypeNames[typ]; ok {
+		return name
+	}
+	return "unknown token"
+}
+
+func (t token) pos() Position {
+	return Position{Line: t.line, Column: t.column}
+}
+
+// describe the token for error messages
+func (t token) String() string {
+	if t.typ == T_EOF {
+		return t.typ.String()
+	}
+	return "'" + t.val + "'"
+}
+
 var tokenTypeMap map[string]tokenType
 var ignoreCharMap map[byte]struct{}
 
@@ -50,6 +106,8 @@ func init() {
 	tokenTypeMap["float32"] = T_Builtin
 	tokenTypeMap["float64"] = T_Builtin
 	tokenTypeMap["string"] = T_Builtin
+	tokenTypeMap["bool"] = T_Builtin
+	tokenTypeMap["bytes"] = T_Builtin
 	tokenTypeMap["list"] = T_Builtin
 	tokenTypeMap["map"] = T_Builtin
 	tokenTypeMap["enum"] = T_Enum
@@ -58,6 +116,8 @@ func init() {
 	tokenTypeMap["seq"] = T_Seq
 	tokenTypeMap["optional"] = T_Optional
 	tokenTypeMap["return"] = T_Return
+	tokenTypeMap["throws"] = T_Throws
+	tokenTypeMap["import"] = T_Import
 	tokenTypeMap["="] = T_Assign
 	tokenTypeMap["("] = T_LSmallBracket
 	tokenTypeMap[")"] = T_RSmallBracket
@@ -70,10 +130,40 @@ func init() {
 
 	ignoreCharMap[' '] = struct{}{}
 	ignoreCharMap['\t'] = struct{}{}
+	ignoreCharMap['\r'] = struct{}{}
 	ignoreCharMap['\n'] = struct{}{}
 	ignoreCharMap['#'] = struct{}{}
 }
 
+// contextualKeywords 是只在特定位置作为关键字的标识符，其他位置仍可作为名字使用，
+// 如成员名stream、option：package与option只在声明的开头，stream只紧跟在方法
+// 签名的'('之后
+var contextualKeywords = map[string]tokenType{
+	"stream":  T_Stream,
+	"package": T_Package,
+	"option":  T_Option,
+}
+
+// IsBuiltin 判断s是否为内置类型，如int32、string
+func IsBuiltin(s string) bool {
+	typ, ok := tokenTypeMap[s]
+	return ok && typ == T_Builtin
+}
+
+// isIdentifier reports whether s is a valid identifier of go, like "user_api"
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
 func isNum(s string) bool {
 	_, err := strconv.Atoi(s)
 